@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Permissions an API key can be granted.
+const PERMISSION_READ = "read"
+const PERMISSION_RUN = "run"
+const PERMISSION_JOBS = "jobs"
+const PERMISSION_CATEGORIES = "categories"
+
+// apikey is a key a client authenticates with. Only the SHA-256 hash of
+// the key is stored.
+type apikey struct {
+	ID          int
+	Name        string
+	AllSites    bool
+	Permissions []string
+}
+
+// apirequest is an authenticated request. Handlers that start a job record
+// its id, so the audit log tells which key triggered which job.
+type apirequest struct {
+	key   apikey
+	site  string
+	JobID int
+}
+
+type apirequestkey struct{}
+
+// authDB is shared by all requests, unlike the connections of sessions.
+var authDB *sql.DB
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// can reports whether the key has the permission.
+func (k apikey) can(permission string) bool {
+	for _, p := range k.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// selectAPIKey finds the key that hashes to the hash of key. Revoked keys
+// are not found.
+func selectAPIKey(key string) (apikey, error) {
+	k := apikey{}
+	var permissions string
+	err := authDB.QueryRow(
+		"SELECT id, name, all_sites, permissions FROM api_keys "+
+			"WHERE key_hash = ? AND revoked_at IS NULL",
+		hashAPIKey(key)).Scan(&k.ID, &k.Name, &k.AllSites, &permissions)
+	if err != nil {
+		return k, err
+	}
+	for _, p := range strings.Split(permissions, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			k.Permissions = append(k.Permissions, p)
+		}
+	}
+	return k, nil
+}
+
+// allowsSite reports whether the key may be used for the site with the
+// given subdomain.
+func (k apikey) allowsSite(subdomain string) (bool, error) {
+	if k.AllSites {
+		return true, nil
+	}
+	if subdomain == "" {
+		return false, nil
+	}
+	var count int
+	err := authDB.QueryRow(
+		"SELECT COUNT(*) FROM api_key_sites aks JOIN sites s ON s.id = aks.site_id "+
+			"WHERE aks.api_key_id = ? AND s.subdomain = ?",
+		k.ID, subdomain).Scan(&count)
+	return count > 0, err
+}
+
+// requestAPIKey returns the key sent as a bearer token or in X-API-Key.
+func requestAPIKey(req *http.Request) string {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// requestSite returns the subdomain a request is for. Requests for a job
+// are for the site of that job, whatever site they name.
+func requestSite(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/jobs/") {
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+		id, _ := strconv.Atoi(strings.Split(path, "/")[0])
+		st, err := jobStatus(id)
+		if err != nil {
+			return ""
+		}
+		return st.Site
+	}
+	return req.FormValue("site")
+}
+
+// authorize wraps a handler so that it only runs for keys with the read
+// permission on GET requests, or the write permission on other requests,
+// for the site of the request. Requests that change something are written
+// to the audit log.
+func authorize(read string, write string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !*requireAuth {
+			handler(rw, req)
+			return
+		}
+
+		permission := write
+		if req.Method == "GET" {
+			permission = read
+		}
+
+		key, err := selectAPIKey(requestAPIKey(req))
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Println(err)
+			}
+			denied(rw, http.StatusUnauthorized, "Invalid API key.")
+			return
+		}
+
+		site := requestSite(req)
+		allowed, err := key.allowsSite(site)
+		if err != nil {
+			log.Println(err)
+		}
+		if !allowed || !key.can(permission) {
+			log.Printf("API key %s denied %s %s for site %s", key.Name, req.Method, req.URL.Path, site)
+			denied(rw, http.StatusForbidden, "API key not allowed to "+permission+" for this site.")
+			return
+		}
+
+		ar := &apirequest{key: key, site: site}
+		handler(rw, req.WithContext(context.WithValue(req.Context(), apirequestkey{}, ar)))
+
+		if req.Method != "GET" {
+			ar.audit(req)
+		}
+	}
+}
+
+func denied(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	fmt.Fprint(rw, Response{Success: false, Message: message})
+}
+
+// apiRequestFrom returns the authenticated request handled, or nil when
+// authentication is turned off.
+func apiRequestFrom(req *http.Request) *apirequest {
+	ar, _ := req.Context().Value(apirequestkey{}).(*apirequest)
+	return ar
+}
+
+// audit records which key made the request and which job it started.
+func (ar *apirequest) audit(req *http.Request) {
+	_, err := authDB.Exec(
+		"INSERT INTO api_audit_log (api_key_id, site, method, path, job_id, "+
+			"created_at) VALUES (?,?,?,?,?,now())",
+		ar.key.ID,
+		ar.site,
+		req.Method,
+		req.URL.Path,
+		sql.NullInt64{Int64: int64(ar.JobID), Valid: ar.JobID > 0},
+	)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// createAPIKey stores a new key and returns it. The key cannot be
+// recovered later, only its hash is kept.
+func createAPIKey(name string, sites []string, permissions []string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	key := "ap_" + hex.EncodeToString(b)
+
+	allSites := len(sites) == 1 && sites[0] == "*"
+	tx, err := authDB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT INTO api_keys (name, key_hash, all_sites, permissions, "+
+			"created_at, updated_at) VALUES (?,?,?,?,now(),now())",
+		name, hashAPIKey(key), allSites, strings.Join(permissions, ","))
+	if err != nil {
+		return "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	if !allSites {
+		for _, site := range sites {
+			res, err := tx.Exec(
+				"INSERT INTO api_key_sites (api_key_id, site_id) "+
+					"SELECT ?, id FROM sites WHERE subdomain = ?", id, site)
+			if err != nil {
+				return "", err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return "", fmt.Errorf("Site %s not found.", site)
+			}
+		}
+	}
+	return key, tx.Commit()
+}
@@ -1,11 +1,16 @@
 package main
 
-import "log"
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+)
 
 type categorymessage struct {
-	category   *category
-	err    error
-	action string
+	category *category
+	err      error
+	action   string
 }
 
 type category struct {
@@ -13,11 +18,19 @@ type category struct {
 	ParentID    int
 	Name        string
 	Slug        string
+	Path        string
 	SiteID      int
 	Search      string
+	Rules       categoryrules
 	Description string
 	CreatedByID int
 	DBAction    int
+
+	IncludeSubcategories bool
+	SyncedHash           string
+
+	// PreviousParentID is set by update when the category moved.
+	PreviousParentID int `json:"-"`
 }
 
 func (c *category) getName() string {
@@ -100,7 +113,7 @@ func (c *category) selectProducts(s *session) ([]categoryproduct, error) {
 			&cp.product.HasCategories,
 			&cp.product.Active,
 			&cp.product.DeletedAt,
-			&cp.category.ID,
+			&cp.CategoryID,
 			&cp.product.ID,
 			&cp.Forced,
 		)
@@ -108,6 +121,7 @@ func (c *category) selectProducts(s *session) ([]categoryproduct, error) {
 			log.Println(err)
 			return categoryProducts, err
 		} else {
+			cp.ProductID = cp.product.ID
 			categoryProducts = append(categoryProducts, cp)
 		}
 	}
@@ -116,105 +130,350 @@ func (c *category) selectProducts(s *session) ([]categoryproduct, error) {
 	return categoryProducts, err
 }
 
+// validate checks the fields editors set on c.
+func (c *category) validate(s *session) error {
+	if strings.TrimSpace(c.Name) == "" {
+		return errors.New("Name is required.")
+	}
+
+	_, err := s.selectCategories()
+	if err != nil {
+		return err
+	}
+	return s.validateParent(c.ID, c.ParentID)
+}
+
 func (c *category) insert(s *session) error {
-	_, err := s.db.Exec(
-		"INSERT INTO categories (name, slug, site_id, created_at, updated_at) "+
-			"VALUES (?,?,?,now(),now())",
-		c.Name,
-		c.Slug,
-		c.SiteID,
-		false,
-	)
-	return err
+	err := c.validate(s)
+	if err != nil {
+		return err
+	}
+
+	slugMutex.Lock()
+	defer slugMutex.Unlock()
+
+	slug := generateSlug(c.Slug)
+	if slug == "" {
+		slug = generateSlug(c.Name)
+	}
+
+	// Another instance may take the slug between picking and inserting it,
+	// in which case the next free one is picked.
+	var res sql.Result
+	for attempt := 1; ; attempt++ {
+		c.Slug, err = uniqueSlug(s, c.getEntityType(), c.SiteID, slug, 0)
+		if err != nil {
+			return err
+		}
+
+		res, err = s.db.Exec(
+			"INSERT INTO categories (parent_id, name, slug, site_id, search, rules, "+
+				"description, include_subcategories, created_at, updated_at) "+
+				"VALUES (?,?,?,?,?,?,?,?,now(),now())",
+			sql.NullInt64{Int64: int64(c.ParentID), Valid: c.ParentID > 0},
+			c.Name,
+			c.Slug,
+			c.SiteID,
+			c.Search,
+			sql.NullString{String: c.Rules.String(), Valid: !c.Rules.isEmpty()},
+			c.Description,
+			c.IncludeSubcategories,
+		)
+		if isDuplicateSlug(err) && attempt < slugAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	c.ID = int(id)
+
+	s.categories = append(s.categories, c)
+	return s.updateCategoryPaths()
 }
 
+// update saves c. A renamed category gets a new unique slug unless an
+// explicit slug is set, and its old slug is kept in the slug history.
+// Parents that would create a cycle are refused.
 func (c *category) update(s *session) error {
-	var err error
-	return err
+	var oldName, oldSlug string
+	var oldParentID sql.NullInt64
+
+	err := c.validate(s)
+	if err != nil {
+		return err
+	}
+
+	slugMutex.Lock()
+	defer slugMutex.Unlock()
+
+	err = s.db.QueryRow(
+		"SELECT name, slug, parent_id FROM categories WHERE id = ?",
+		c.ID).Scan(&oldName, &oldSlug, &oldParentID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if int(oldParentID.Int64) != c.ParentID {
+		c.PreviousParentID = int(oldParentID.Int64)
+	}
+
+	slug := ""
+	if c.Slug != "" && c.Slug != oldSlug {
+		slug = generateSlug(c.Slug)
+	} else if oldSlug == "" || generateSlug(oldName) != generateSlug(c.Name) {
+		slug = generateSlug(c.Name)
+	}
+
+	// Like on insert, a slug taken by another instance in the meantime is
+	// replaced by the next free one.
+	for attempt := 1; ; attempt++ {
+		c.Slug = oldSlug
+		if slug != "" {
+			c.Slug, err = uniqueSlug(s, c.getEntityType(), c.SiteID, slug, c.ID)
+			if err != nil {
+				return err
+			}
+
+			if c.Slug != oldSlug {
+				err = saveSlugHistory(s, c.getEntityType(), c.SiteID, c.ID, oldSlug)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		_, err = s.db.Exec(
+			"UPDATE categories SET parent_id = ?, name = ?, slug = ?, search = ?, "+
+				"rules = ?, description = ?, include_subcategories = ?, "+
+				"updated_at = now() WHERE id = ?",
+			sql.NullInt64{Int64: int64(c.ParentID), Valid: c.ParentID > 0},
+			c.Name,
+			c.Slug,
+			c.Search,
+			sql.NullString{String: c.Rules.String(), Valid: !c.Rules.isEmpty()},
+			c.Description,
+			c.IncludeSubcategories,
+			c.ID,
+		)
+		if isDuplicateSlug(err) && attempt < slugAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	// The description may use other placeholders now.
+	err = c.saveStats(s)
+	if err != nil {
+		return err
+	}
+
+	// Paths of c and its subcategories follow the new slug and parent.
+	for _, ci := range s.categories {
+		if sc, ok := ci.(*category); ok && sc.ID == c.ID {
+			*sc = *c
+		}
+	}
+	return s.updateCategoryPaths()
 }
 
+// delete soft deletes c and detaches its products. Subcategories move up
+// to the parent of c.
 func (c *category) delete(s *session) error {
 	_, err := s.db.Exec("UPDATE categories SET deleted_at = NOW() WHERE id = ?", c.ID)
-	return err
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE categories SET parent_id = ?, updated_at = now() "+
+			"WHERE parent_id = ? AND deleted_at IS NULL",
+		sql.NullInt64{Int64: int64(c.ParentID), Valid: c.ParentID > 0},
+		c.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	products, err := c.selectProducts(s)
+	if err != nil {
+		return err
+	}
+	for _, cp := range products {
+		err = cp.delete(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	remaining := []categoryinterface{}
+	for _, ci := range s.categories {
+		sc, ok := ci.(*category)
+		if ok && sc.ID == c.ID {
+			continue
+		}
+		if ok && sc.ParentID == c.ID {
+			sc.ParentID = c.ParentID
+		}
+		remaining = append(remaining, ci)
+	}
+	s.categories = remaining
+	return s.updateCategoryPaths()
+}
+
+// matchProducts returns the products matching the search string and the
+// rules of c. A category without a search string matches on its rules
+// alone, and a category with neither matches nothing.
+func (c *category) matchProducts(s *session, products []product) []product {
+	matches := []product{}
+	if strings.TrimSpace(c.Search) == "" && c.Rules.isEmpty() {
+		return matches
+	}
+
+	query := parseSearchQuery(c.Search)
+	for _, p := range products {
+		if !c.Rules.match(p) {
+			continue
+		}
+		if strings.TrimSpace(c.Search) != "" {
+			ok, _ := query.match(s.searchDocument(p))
+			if !ok {
+				continue
+			}
+		}
+		matches = append(matches, p)
+	}
+	return matches
+}
+
+// treeMatches returns the products matching c and, if c includes its
+// subcategories, the products matching any of its descendants.
+func (c *category) treeMatches(s *session, products []product) []product {
+	return c.addSubcategoryMatches(s, products, s.categoryMatches(c, products))
+}
+
+// addSubcategoryMatches adds the products matching the descendants of c to
+// matches, if c includes its subcategories.
+func (c *category) addSubcategoryMatches(s *session, products []product, matches []product) []product {
+	if !c.IncludeSubcategories {
+		return matches
+	}
+
+	seen := make(map[int]bool)
+	for _, p := range matches {
+		seen[p.ID] = true
+	}
+
+	visited := map[int]bool{c.ID: true}
+	queue := s.subcategories(c)
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = queue[1:]
+		if visited[child.ID] {
+			continue
+		}
+		visited[child.ID] = true
+
+		for _, p := range s.categoryMatches(child, products) {
+			if !seen[p.ID] {
+				seen[p.ID] = true
+				matches = append(matches, p)
+			}
+		}
+		queue = append(queue, s.subcategories(child)...)
+	}
+	return matches
 }
 
+// syncProducts attaches the products c and its subcategories match and
+// detaches the others that are not forced. The category is only marked as
+// synced when every change was written, so that a failed sync runs again.
 func (c *category) syncProducts(s *session) error {
-	var err error
+	err := c.syncMatches(s)
+
+	// A cancelled sync is not complete and must run again.
+	if err == nil {
+		err = s.ctx.Err()
+	}
+	if err == nil {
+		err = c.saveSyncedHash(s)
+	}
+	if err == nil {
+		err = c.saveStats(s)
+	}
 
+	s.CategoryDone <- categorymessage{category: c, err: nil, action: "syncProducts"}
+	return err
+}
+
+// syncMatches does the attaching and detaching of syncProducts and returns
+// the first error. Nothing is changed when the current products, the site
+// products or the exclusions cannot be loaded.
+func (c *category) syncMatches(s *session) error {
 	activeProducts, err := c.selectProducts(s)
 	if err != nil {
 		log.Println(err)
+		return err
 	}
 
-	searchProducts := []product{}
-	log.Println(s.site.ID, c.Search)
-	rows, err := s.searchCategoryProductsStmt.Query(s.site.ID, c.Search)
+	siteProducts, err := s.selectSiteProducts()
 	if err != nil {
 		log.Println(err)
-	} else {
-		defer rows.Close()
-		for rows.Next() {
-			p := product{}
-			err := rows.Scan(
-				&p.ID,
-				&p.SiteID,
-				&p.FeedID,
-				&p.BrandID,
-				&p.NameByUser,
-				&p.Name,
-				&p.Slug,
-				&p.Identifier,
-				&p.Price,
-				&p.RegularPrice,
-				&p.DescriptionByUser,
-				&p.Description,
-				&p.Currency,
-				&p.ProductURL,
-				&p.GraphicURL,
-				&p.ShippingPrice,
-				&p.InStock,
-				&p.Points,
-				&p.HasCategories,
-				&p.Active,
-				&p.CreatedAt,
-				&p.UpdatedAt,
-				&p.DeletedAt,
-			)
+		return err
+	}
 
-			if err != nil {
-				log.Println(err)
-			} else {
-				searchProducts = append(searchProducts, p)
+	// Without the exclusions every excluded product would be attached again.
+	excluded, err := c.selectExclusions(s)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	var syncErr error
+	searchProducts := c.treeMatches(s, siteProducts)
+	for _, p := range searchProducts {
+		if s.ctx.Err() != nil {
+			break
+		}
+		indexes := p.indexesOf(activeProducts)
+		if len(indexes) == 0 && !excluded[p.ID] {
+			err := p.attachCategory(s, c)
+			if err != nil && syncErr == nil {
+				syncErr = err
 			}
 		}
+	}
 
-		for _, p := range searchProducts {
-			indexes := p.indexesOf(activeProducts)
-			if len(indexes) == 0 {
-				p.attachCategory(s, c)
+	for _, p := range activeProducts {
+		if s.ctx.Err() != nil {
+			break
+		}
+		indexes := []int{}
+		for i, ele := range searchProducts {
+			if ele.ID == p.product.ID {
+				indexes = append(indexes, i)
 			}
 		}
-
-		for _, p := range activeProducts {
-			indexes := []int{}
-			for i, ele := range searchProducts {
-				if ele.ID == p.product.ID {
-					indexes = append(indexes, i)
-				}
+		if len(indexes) == 0 {
+			cp, err := p.selectCategoryProduct(s, c)
+			if err == nil && cp.Forced == false {
+				err = p.detachCategory(s, cp)
+			} else if err != nil {
+				log.Println(err)
 			}
-			if len(indexes) == 0 {
-				cp, err := p.selectCategoryProduct(s, c)
-				if err != nil {
-					log.Println(err)
-				}
-
-				if cp.Forced == false {
-					p.detachCategory(s, cp)
-				}
+			if err != nil && syncErr == nil {
+				syncErr = err
 			}
 		}
 	}
-	
-	s.CategoryDone <- categorymessage{category: c, err: nil, action: "syncProducts"}
-	return err
+	return syncErr
 }
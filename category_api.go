@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// categoryFromRequest returns the category named by the "category" form
+// value, or a new category of the site if there is none, with the fields
+// the request sets applied on top.
+func categoryFromRequest(s *session, req *http.Request) (*category, error) {
+	c := &category{SiteID: int(s.site.ID)}
+
+	_, err := s.selectCategories()
+	if err != nil {
+		return c, err
+	}
+
+	if req.FormValue("category") != "" {
+		id, _ := strconv.Atoi(req.FormValue("category"))
+		existing, ok := s.categoriesByID()[id]
+		if !ok {
+			return c, errors.New("Category not found.")
+		}
+		*c = *existing
+		c.SiteID = int(s.site.ID)
+	}
+
+	if _, ok := req.Form["name"]; ok {
+		c.Name = req.FormValue("name")
+	}
+	if _, ok := req.Form["search"]; ok {
+		c.Search = req.FormValue("search")
+	}
+	if _, ok := req.Form["description"]; ok {
+		c.Description = req.FormValue("description")
+	}
+	if _, ok := req.Form["parent"]; ok {
+		c.ParentID, _ = strconv.Atoi(req.FormValue("parent"))
+	}
+	if _, ok := req.Form["include_subcategories"]; ok {
+		c.IncludeSubcategories, _ = strconv.ParseBool(req.FormValue("include_subcategories"))
+	}
+	if _, ok := req.Form["rules"]; ok {
+		c.Rules = categoryrules{}
+		if req.FormValue("rules") != "" {
+			err = json.Unmarshal([]byte(req.FormValue("rules")), &c.Rules)
+			if err != nil {
+				return c, errors.New("Invalid rules: " + err.Error())
+			}
+		}
+	}
+	return c, nil
+}
+
+// categoryTreeHandler returns the categories of a site as a tree.
+func categoryTreeHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			_, err := s.selectCategories()
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(s.categories)) + " categories.",
+					Data:    s.categoryTree(),
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// categoryPreviewHandler shows which products a proposed search string and
+// rules would match, and how that differs from the category today.
+func categoryPreviewHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			c, err := categoryFromRequest(&s, req)
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				preview, err := c.preview(&s)
+				if err != nil {
+					resp = Response{Success: false, Message: err.Error()}
+				} else {
+					resp = Response{
+						Success: true,
+						Message: strconv.Itoa(preview.Count) + " products.",
+						Data:    preview,
+					}
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// unmappedCategoriesHandler lists the merchant categories that are not
+// mapped to a category of the site, by product count.
+func unmappedCategoriesHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			unmapped, err := s.selectUnmappedCategories()
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(unmapped)) + " unmapped merchant categories.",
+					Data:    unmapped,
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// categoryMappingsHandler lists the merchant category mappings of a site
+// on GET and adds a mapping on POST.
+func categoryMappingsHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" || req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success && req.Method == "GET" {
+			mappings, err := s.selectCategoryMappings()
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(mappings)) + " mappings.",
+					Data:    mappings,
+				}
+			}
+		} else if resp.Success {
+			m := categorymapping{MerchantCategory: normaliseText(req.FormValue("merchant_category"))}
+			m.CategoryID, _ = strconv.Atoi(req.FormValue("category"))
+			m.FeedID, _ = strconv.Atoi(req.FormValue("feed"))
+			m.NetworkID, _ = strconv.Atoi(req.FormValue("network"))
+
+			_, err := s.selectCategories()
+			_, ok := s.categoriesByID()[m.CategoryID]
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else if !ok {
+				resp = Response{Success: false, Message: "Category not found."}
+			} else if m.MerchantCategory == "" {
+				resp = Response{Success: false, Message: "Merchant category is required."}
+			} else if err = m.insert(&s); err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{Success: true, Message: "Mapping added.", Data: m}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// deleteCategoryMappingHandler removes a merchant category mapping.
+func deleteCategoryMappingHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			m := categorymapping{}
+			m.ID, _ = strconv.Atoi(req.FormValue("mapping"))
+			err := m.delete(&s)
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{Success: true, Message: "Mapping deleted."}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// membershipHandler pins a product into a category, keeps it out of the
+// category or resets it to what the category sync decides.
+func membershipHandler(rw http.ResponseWriter, req *http.Request, membership string) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			resp = setMembership(&s, req, membership)
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+func setMembership(s *session, req *http.Request, membership string) Response {
+	_, err := s.selectCategories()
+	if err != nil {
+		return Response{Success: false, Message: err.Error()}
+	}
+	categoryID, _ := strconv.Atoi(req.FormValue("category"))
+	c, ok := s.categoriesByID()[categoryID]
+	if !ok {
+		return Response{Success: false, Message: "Category not found."}
+	}
+
+	products, err := s.selectSiteProducts()
+	if err != nil {
+		return Response{Success: false, Message: err.Error()}
+	}
+	productID, _ := strconv.Atoi(req.FormValue("product"))
+	for _, p := range products {
+		if p.ID != productID {
+			continue
+		}
+
+		cp, err := c.setMembership(s, p, membership)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		return Response{
+			Success: true,
+			Message: "Membership updated.",
+			Data: Map{
+				"category_id": c.ID,
+				"product_id":  p.ID,
+				"attached":    cp.ID > 0,
+				"forced":      cp.Forced,
+				"excluded":    cp.Excluded,
+			},
+		}
+	}
+	return Response{Success: false, Message: "Product not found."}
+}
+
+func includeProductHandler(rw http.ResponseWriter, req *http.Request) {
+	membershipHandler(rw, req, MEMBERSHIP_INCLUDE)
+}
+
+func excludeProductHandler(rw http.ResponseWriter, req *http.Request) {
+	membershipHandler(rw, req, MEMBERSHIP_EXCLUDE)
+}
+
+func resetProductHandler(rw http.ResponseWriter, req *http.Request) {
+	membershipHandler(rw, req, MEMBERSHIP_RESET)
+}
+
+// saveCategoryHandler creates or updates a category and re-syncs the
+// products of just that category.
+func saveCategoryHandler(rw http.ResponseWriter, req *http.Request, create bool) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+
+		var c *category
+		var err error
+		if resp.Success {
+			if create && req.FormValue("category") != "" {
+				err = errors.New("Category can not be set when creating.")
+			} else if !create && req.FormValue("category") == "" {
+				err = errors.New("Category is required.")
+			}
+			if err == nil {
+				c, err = categoryFromRequest(&s, req)
+			}
+			if err == nil {
+				if _, ok := req.Form["slug"]; ok {
+					c.Slug = req.FormValue("slug")
+				}
+				if create {
+					err = c.insert(&s)
+				} else {
+					err = c.update(&s)
+				}
+			}
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{Success: true, Message: "Category saved.", Data: c}
+			}
+		}
+
+		if resp.Success {
+			s.onlyCategoryID = c.ID
+			s.previousParentID = c.PreviousParentID
+			resp = queueAction(s, "refresh", requestPriority(req), resp)
+		} else {
+			s.db.Close()
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+func createCategoryHandler(rw http.ResponseWriter, req *http.Request) {
+	saveCategoryHandler(rw, req, true)
+}
+
+func updateCategoryHandler(rw http.ResponseWriter, req *http.Request) {
+	saveCategoryHandler(rw, req, false)
+}
+
+// deleteCategoryHandler soft deletes a category and re-syncs its parent.
+func deleteCategoryHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+
+		parentID := 0
+		if resp.Success {
+			_, err := s.selectCategories()
+			id, _ := strconv.Atoi(req.FormValue("category"))
+			c, ok := s.categoriesByID()[id]
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else if !ok {
+				resp = Response{Success: false, Message: "Category not found."}
+			} else if err = c.delete(&s); err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				parentID = c.ParentID
+				resp = Response{Success: true, Message: "Category deleted."}
+			}
+		}
+
+		if parentID > 0 {
+			s.onlyCategoryID = parentID
+			resp = queueAction(s, "refresh", requestPriority(req), resp)
+		} else {
+			s.db.Close()
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// suggestionsHandler lists the pending category suggestions of a site,
+// optionally for one product.
+func suggestionsHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			productID, _ := strconv.Atoi(req.FormValue("product"))
+			limit, err := strconv.Atoi(req.FormValue("limit"))
+			if err != nil || limit <= 0 {
+				limit = 100
+			}
+
+			suggestions, err := s.selectSuggestions(productID, limit)
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(suggestions)) + " suggestions.",
+					Data:    suggestions,
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// generateSuggestionsHandler retrains the classifier of a site and
+// replaces its pending suggestions.
+func generateSuggestionsHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+
+		if resp.Success {
+			resp = queueAction(s, "suggest", requestPriority(req), resp)
+		} else {
+			s.db.Close()
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// reviewSuggestionHandler accepts or rejects a pending suggestion.
+func reviewSuggestionHandler(rw http.ResponseWriter, req *http.Request, accept bool) {
+	if req.Method == "POST" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			id, _ := strconv.Atoi(req.FormValue("suggestion"))
+			sg, err := s.selectSuggestion(id)
+			if err == nil && sg.Status != SUGGESTION_PENDING {
+				err = errors.New("Suggestion is already " + sg.Status + ".")
+			}
+			if err == nil && accept {
+				err = sg.accept(&s)
+			} else if err == nil {
+				err = sg.reject(&s)
+			}
+
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{Success: true, Message: "Suggestion " + sg.Status + ".", Data: sg}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+func acceptSuggestionHandler(rw http.ResponseWriter, req *http.Request) {
+	reviewSuggestionHandler(rw, req, true)
+}
+
+func rejectSuggestionHandler(rw http.ResponseWriter, req *http.Request) {
+	reviewSuggestionHandler(rw, req, false)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strings"
+)
+
+// categorymapping puts the products of a merchant category into one of
+// our categories. A mapping can be limited to one feed or one network.
+type categorymapping struct {
+	ID               int    `json:"id"`
+	FeedID           int    `json:"feed_id,omitempty"`
+	NetworkID        int    `json:"network_id,omitempty"`
+	MerchantCategory string `json:"merchant_category"`
+	CategoryID       int    `json:"category_id"`
+}
+
+// unmappedcategory is a merchant category no mapping covers.
+type unmappedcategory struct {
+	FeedID           int    `json:"feed_id"`
+	NetworkID        int    `json:"network_id"`
+	MerchantCategory string `json:"merchant_category"`
+	Products         int    `json:"products"`
+}
+
+// applies reports whether the mapping covers p.
+func (m categorymapping) applies(p product, networkID int) bool {
+	if m.FeedID > 0 && m.FeedID != p.FeedID {
+		return false
+	}
+	if m.NetworkID > 0 && m.NetworkID != networkID {
+		return false
+	}
+	return inMerchantCategory(p.MerchantCategory, m.MerchantCategory)
+}
+
+// selectCategoryMappings loads the category mappings of the site. They are
+// cached for the rest of the session.
+func (s *session) selectCategoryMappings() ([]categorymapping, error) {
+	if s.categoryMappings != nil {
+		return s.categoryMappings, nil
+	}
+
+	mappings := []categorymapping{}
+	rows, err := s.db.Query(
+		"SELECT id, feed_id, network_id, merchant_category, category_id "+
+			"FROM category_mappings WHERE site_id = ?", s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return mappings, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var feedID, networkID sql.NullInt64
+		m := categorymapping{}
+		err := rows.Scan(&m.ID, &feedID, &networkID, &m.MerchantCategory, &m.CategoryID)
+		if err != nil {
+			log.Println(err)
+			return mappings, err
+		}
+		m.FeedID = int(feedID.Int64)
+		m.NetworkID = int(networkID.Int64)
+		mappings = append(mappings, m)
+	}
+
+	err = rows.Err()
+	if err == nil {
+		s.categoryMappings = mappings
+	}
+	return mappings, err
+}
+
+// selectFeedNetworks returns the network of every feed of the site. It is
+// cached for the rest of the session.
+func (s *session) selectFeedNetworks() (map[int]int, error) {
+	if s.feedNetworks != nil {
+		return s.feedNetworks, nil
+	}
+
+	networks := make(map[int]int)
+	rows, err := s.db.Query("SELECT id, network_id FROM feeds WHERE site_id = ?", s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return networks, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var feedID, networkID int
+		err := rows.Scan(&feedID, &networkID)
+		if err != nil {
+			log.Println(err)
+			return networks, err
+		}
+		networks[feedID] = networkID
+	}
+
+	err = rows.Err()
+	if err == nil {
+		s.feedNetworks = networks
+	}
+	return networks, err
+}
+
+// mappedProducts returns the products a mapping puts into c, with the
+// merchant category that mapped each of them.
+func (c *category) mappedProducts(s *session, products []product) ([]product, map[int]string) {
+	matches := []product{}
+	reasons := make(map[int]string)
+
+	mappings, err := s.selectCategoryMappings()
+	if err != nil {
+		return matches, reasons
+	}
+	networks, err := s.selectFeedNetworks()
+	if err != nil {
+		return matches, reasons
+	}
+
+	own := []categorymapping{}
+	for _, m := range mappings {
+		if m.CategoryID == c.ID {
+			own = append(own, m)
+		}
+	}
+	if len(own) == 0 {
+		return matches, reasons
+	}
+
+	for _, p := range products {
+		for _, m := range own {
+			if m.applies(p, networks[p.FeedID]) {
+				matches = append(matches, p)
+				reasons[p.ID] = m.MerchantCategory
+				break
+			}
+		}
+	}
+	return matches, reasons
+}
+
+// selectUnmappedCategories lists the merchant categories of live products
+// that no mapping covers, most products first.
+func (s *session) selectUnmappedCategories() ([]unmappedcategory, error) {
+	unmapped := []unmappedcategory{}
+
+	products, err := s.selectSiteProducts()
+	if err != nil {
+		return unmapped, err
+	}
+	mappings, err := s.selectCategoryMappings()
+	if err != nil {
+		return unmapped, err
+	}
+	networks, err := s.selectFeedNetworks()
+	if err != nil {
+		return unmapped, err
+	}
+
+	counts := make(map[unmappedcategory]int)
+	for _, p := range products {
+		if p.isDeleted() || strings.TrimSpace(p.MerchantCategory) == "" {
+			continue
+		}
+
+		mapped := false
+		for _, m := range mappings {
+			if m.applies(p, networks[p.FeedID]) {
+				mapped = true
+				break
+			}
+		}
+		if !mapped {
+			key := unmappedcategory{
+				FeedID:           p.FeedID,
+				NetworkID:        networks[p.FeedID],
+				MerchantCategory: p.MerchantCategory,
+			}
+			counts[key]++
+		}
+	}
+
+	for key, count := range counts {
+		key.Products = count
+		unmapped = append(unmapped, key)
+	}
+	sort.Slice(unmapped, func(i, j int) bool {
+		if unmapped[i].Products != unmapped[j].Products {
+			return unmapped[i].Products > unmapped[j].Products
+		}
+		return unmapped[i].MerchantCategory < unmapped[j].MerchantCategory
+	})
+	return unmapped, nil
+}
+
+// insert saves a new mapping for the site of the session.
+func (m *categorymapping) insert(s *session) error {
+	res, err := s.db.Exec(
+		"INSERT INTO category_mappings (site_id, feed_id, network_id, "+
+			"merchant_category, category_id, created_at, updated_at) "+
+			"VALUES (?,?,?,?,?,now(),now())",
+		s.site.ID,
+		sql.NullInt64{Int64: int64(m.FeedID), Valid: m.FeedID > 0},
+		sql.NullInt64{Int64: int64(m.NetworkID), Valid: m.NetworkID > 0},
+		m.MerchantCategory,
+		m.CategoryID,
+	)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	m.ID = int(id)
+	s.categoryMappings = nil
+	return err
+}
+
+// delete removes the mapping from the site of the session.
+func (m *categorymapping) delete(s *session) error {
+	_, err := s.db.Exec(
+		"DELETE FROM category_mappings WHERE id = ? AND site_id = ?", m.ID, s.site.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	s.categoryMappings = nil
+	return err
+}
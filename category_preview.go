@@ -0,0 +1,141 @@
+package main
+
+import "log"
+
+// previewmatch is a product a proposed category would contain, and why.
+type previewmatch struct {
+	ProductID   int      `json:"product_id"`
+	Name        string   `json:"name"`
+	Terms       []string `json:"terms"`
+	Merchant    string   `json:"merchant_category,omitempty"`
+	Subcategory bool     `json:"subcategory"`
+	Attached    bool     `json:"attached"`
+}
+
+// categorypreview compares what a proposed category would contain with
+// what is attached to the category today.
+type categorypreview struct {
+	Count        int            `json:"count"`
+	CurrentCount int            `json:"current_count"`
+	Delta        int            `json:"delta"`
+	WouldAttach  []int          `json:"would_attach"`
+	WouldDetach  []int          `json:"would_detach"`
+	KeptForced   []int          `json:"kept_forced"`
+	KeptExcluded []int          `json:"kept_excluded"`
+	Matches      []previewmatch `json:"matches"`
+}
+
+// preview evaluates c against the products of the site without changing
+// anything. Forced products are never detached and excluded products never
+// attached, just as in syncProducts.
+func (c *category) preview(s *session) (categorypreview, error) {
+	preview := categorypreview{
+		WouldAttach:  []int{},
+		WouldDetach:  []int{},
+		KeptForced:   []int{},
+		KeptExcluded: []int{},
+		Matches:      []previewmatch{},
+	}
+
+	products, err := s.selectSiteProducts()
+	if err != nil {
+		return preview, err
+	}
+
+	current := make(map[int]categoryproduct)
+	excluded := make(map[int]bool)
+	if c.ID > 0 {
+		activeProducts, err := c.selectProducts(s)
+		if err != nil {
+			log.Println(err)
+			return preview, err
+		}
+		for _, cp := range activeProducts {
+			current[cp.product.ID] = cp
+		}
+		excluded, err = c.selectExclusions(s)
+		if err != nil {
+			return preview, err
+		}
+	}
+
+	// Own matches are not taken from the session cache, c holds the
+	// proposed search and rules rather than the saved ones.
+	own := c.matchProducts(s, products)
+	matched := make(map[int]bool)
+	query := parseSearchQuery(c.Search)
+	for _, p := range own {
+		_, terms := query.match(s.searchDocument(p))
+		_, attached := current[p.ID]
+		preview.Matches = append(preview.Matches, previewmatch{
+			ProductID: p.ID,
+			Name:      p.getName(),
+			Terms:     terms,
+			Attached:  attached,
+		})
+		matched[p.ID] = true
+	}
+
+	mapped, reasons := c.mappedProducts(s, products)
+	for _, p := range mapped {
+		if matched[p.ID] {
+			continue
+		}
+		_, attached := current[p.ID]
+		preview.Matches = append(preview.Matches, previewmatch{
+			ProductID: p.ID,
+			Name:      p.getName(),
+			Terms:     []string{},
+			Merchant:  reasons[p.ID],
+			Attached:  attached,
+		})
+		matched[p.ID] = true
+		own = append(own, p)
+	}
+
+	for _, p := range c.addSubcategoryMatches(s, products, own) {
+		if matched[p.ID] {
+			continue
+		}
+		_, attached := current[p.ID]
+		preview.Matches = append(preview.Matches, previewmatch{
+			ProductID:   p.ID,
+			Name:        p.getName(),
+			Terms:       []string{},
+			Subcategory: true,
+			Attached:    attached,
+		})
+		matched[p.ID] = true
+	}
+
+	matches := []previewmatch{}
+	for _, m := range preview.Matches {
+		if excluded[m.ProductID] {
+			preview.KeptExcluded = append(preview.KeptExcluded, m.ProductID)
+			continue
+		}
+		if !m.Attached {
+			preview.WouldAttach = append(preview.WouldAttach, m.ProductID)
+		}
+		matches = append(matches, m)
+	}
+	preview.Matches = matches
+
+	count := len(preview.Matches)
+	for id, cp := range current {
+		if matched[id] {
+			continue
+		}
+		if cp.Forced {
+			preview.KeptForced = append(preview.KeptForced, id)
+			count++
+		} else {
+			preview.WouldDetach = append(preview.WouldDetach, id)
+		}
+	}
+
+	preview.Count = count
+	preview.CurrentCount = len(current)
+	preview.Delta = count - len(current)
+	return preview, nil
+}
@@ -2,6 +2,10 @@ package main
 
 import "log"
 
+const MEMBERSHIP_INCLUDE = "include"
+const MEMBERSHIP_EXCLUDE = "exclude"
+const MEMBERSHIP_RESET = "reset"
+
 type categoryproduct struct {
 	category
 	product
@@ -9,6 +13,9 @@ type categoryproduct struct {
 	CategoryID int
 	ProductID  int
 	Forced     bool
+	// Excluded is only set by setMembership. Exclusions are not rows of
+	// category_product but of category_product_exclusions.
+	Excluded bool
 }
 
 func (c *categoryproduct) getName() string {
@@ -60,15 +67,162 @@ func (c *categoryproduct) setCategoryID(id int) {
 }
 
 func (c *categoryproduct) insert(s *session) error {
-	var err error
-	return err
+	res, err := s.db.Exec(
+		"INSERT INTO category_product (category_id, product_id, forced, "+
+			"created_at, updated_at) VALUES (?,?,?,now(),now())",
+		c.CategoryID,
+		c.ProductID,
+		c.Forced,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	c.ID = int(id)
+	return refreshHasCategories(s, c.ProductID)
 }
+
 func (c *categoryproduct) update(s *session) error {
-	var err error
-	return err
+	_, err := s.db.Exec(
+		"UPDATE category_product SET forced = ?, "+
+			"updated_at = now() WHERE id = ?",
+		c.Forced,
+		c.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return refreshHasCategories(s, c.ProductID)
 }
+
 func (c *categoryproduct) delete(s *session) error {
-	var err error
+	_, err := s.db.Exec("DELETE FROM category_product WHERE id = ?", c.ID)
+	if err != nil {
+		return err
+	}
+	return refreshHasCategories(s, c.ProductID)
+}
+
+// setMembership changes how p belongs to c. Included products stay in c
+// whatever its search and rules say, excluded products are kept out of it,
+// and reset hands the product back to the category sync.
+func (c *category) setMembership(s *session, p product, membership string) (categoryproduct, error) {
+	cp, err := p.selectCategoryProduct(s, c)
+	if err != nil {
+		return cp, err
+	}
+	cp.CategoryID = c.ID
+	cp.ProductID = p.ID
+
+	if membership == MEMBERSHIP_EXCLUDE {
+		if cp.ID > 0 {
+			err = cp.delete(s)
+			if err != nil {
+				return cp, err
+			}
+			cp.ID = 0
+		}
+		cp.Forced = false
+		cp.Excluded = true
+		return cp, c.exclude(s, p.ID)
+	}
+
+	err = c.unexclude(s, p.ID)
+	if err != nil {
+		return cp, err
+	}
+	switch membership {
+	case MEMBERSHIP_INCLUDE:
+		cp.Forced = true
+	default:
+		cp.Forced = false
+
+		products, err := s.selectSiteProducts()
+		if err != nil {
+			return cp, err
+		}
+		matched := false
+		for _, m := range c.treeMatches(s, products) {
+			if m.ID == p.ID {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			if cp.ID > 0 {
+				err = cp.delete(s)
+				cp.ID = 0
+			}
+			return cp, err
+		}
+	}
+
+	if cp.ID > 0 {
+		err = cp.update(s)
+	} else {
+		err = cp.insert(s)
+	}
+	return cp, err
+}
+
+// exclude keeps the product out of c until it is included or reset.
+func (c *category) exclude(s *session, productID int) error {
+	_, err := s.db.Exec(
+		"INSERT IGNORE INTO category_product_exclusions (category_id, product_id, "+
+			"created_at, updated_at) VALUES (?,?,now(),now())",
+		c.ID, productID)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+func (c *category) unexclude(s *session, productID int) error {
+	_, err := s.db.Exec(
+		"DELETE FROM category_product_exclusions WHERE category_id = ? AND product_id = ?",
+		c.ID, productID)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// selectExclusions returns the ids of the products kept out of c.
+func (c *category) selectExclusions(s *session) (map[int]bool, error) {
+	excluded := make(map[int]bool)
+	rows, err := s.db.Query(
+		"SELECT product_id FROM category_product_exclusions WHERE category_id = ?", c.ID)
+	if err != nil {
+		log.Println(err)
+		return excluded, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Println(err)
+			return excluded, err
+		}
+		excluded[id] = true
+	}
+	return excluded, rows.Err()
+}
+
+// refreshHasCategories recalculates has_categories of a product.
+func refreshHasCategories(s *session, productID int) error {
+	_, err := s.db.Exec(
+		"UPDATE products SET has_categories = EXISTS (SELECT 1 FROM "+
+			"category_product WHERE product_id = ?) WHERE id = ?",
+		productID, productID)
+	if err != nil {
+		log.Println(err)
+	}
 	return err
 }
 
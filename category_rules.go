@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+// categoryrules narrow down the products a category search string matches.
+// They are stored as JSON on the category, and unset fields do not filter.
+type categoryrules struct {
+	MinPrice          float64  `json:"min_price,omitempty"`
+	MaxPrice          float64  `json:"max_price,omitempty"`
+	Brands            []string `json:"brands,omitempty"`
+	FeedIDs           []int    `json:"feed_ids,omitempty"`
+	NetworkCategories []string `json:"network_categories,omitempty"`
+	InStockOnly       bool     `json:"in_stock_only,omitempty"`
+	MinDiscount       float64  `json:"min_discount,omitempty"`
+}
+
+// parseCategoryRules decodes the rules column of a category.
+func parseCategoryRules(str sql.NullString) (categoryrules, error) {
+	var rules categoryrules
+	if strings.TrimSpace(str.String) == "" {
+		return rules, nil
+	}
+	err := json.Unmarshal([]byte(str.String), &rules)
+	return rules, err
+}
+
+// isEmpty reports whether the rules do not filter anything.
+func (r categoryrules) isEmpty() bool {
+	return r.MinPrice == 0 && r.MaxPrice == 0 && len(r.Brands) == 0 &&
+		len(r.FeedIDs) == 0 && len(r.NetworkCategories) == 0 &&
+		r.InStockOnly == false && r.MinDiscount == 0
+}
+
+// String returns the rules as stored in the database.
+func (r categoryrules) String() string {
+	if r.isEmpty() {
+		return ""
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// discount returns how many percent below its regular price p is sold.
+func (p product) discount() float64 {
+	if p.RegularPrice <= 0 || p.Price <= 0 || p.Price >= p.RegularPrice {
+		return 0
+	}
+	return (p.RegularPrice - p.Price) / p.RegularPrice * 100
+}
+
+// match reports whether p passes every rule that is set.
+func (r categoryrules) match(p product) bool {
+	if r.MinPrice > 0 && p.Price < r.MinPrice {
+		return false
+	}
+	if r.MaxPrice > 0 && p.Price > r.MaxPrice {
+		return false
+	}
+	if r.InStockOnly && !p.InStock {
+		return false
+	}
+	if r.MinDiscount > 0 && p.discount() < r.MinDiscount {
+		return false
+	}
+
+	if len(r.FeedIDs) > 0 {
+		found := false
+		for _, id := range r.FeedIDs {
+			if id == p.FeedID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Brands) > 0 {
+		found := false
+		for _, brand := range r.Brands {
+			if normaliseMPN(brand) == normaliseMPN(p.Brand) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.NetworkCategories) > 0 {
+		found := false
+		for _, c := range r.NetworkCategories {
+			if inMerchantCategory(p.MerchantCategory, c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inMerchantCategory reports whether path is the merchant category c or
+// one of its subcategories, ignoring case.
+func inMerchantCategory(path string, c string) bool {
+	path = strings.ToLower(strings.TrimSpace(path))
+	c = strings.ToLower(strings.TrimSpace(c))
+	if c == "" {
+		return false
+	}
+	return path == c || strings.HasPrefix(path, c+MERCHANT_CATEGORY_SEPARATOR)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// categorystats are the figures category landing pages show. They are
+// stored after every sync of the category.
+type categorystats struct {
+	CategoryID   int      `json:"category_id"`
+	ProductCount int      `json:"product_count"`
+	MinPrice     float64  `json:"min_price"`
+	MaxPrice     float64  `json:"max_price"`
+	OnSaleCount  int      `json:"on_sale_count"`
+	Brands       []string `json:"brands"`
+}
+
+// selectStats computes the stats of c from its live products.
+func (c *category) selectStats(s *session) (categorystats, error) {
+	st := categorystats{CategoryID: c.ID, Brands: []string{}}
+
+	var minPrice, maxPrice sql.NullFloat64
+	var onSale sql.NullInt64
+	err := s.db.QueryRow(
+		"SELECT COUNT(*), MIN(p.price), MAX(p.price), "+
+			"SUM(p.price > 0 AND p.regular_price > p.price) "+
+			"FROM category_product cp JOIN products p ON p.id = cp.product_id "+
+			"WHERE cp.category_id = ? AND p.deleted_at IS NULL",
+		c.ID).Scan(&st.ProductCount, &minPrice, &maxPrice, &onSale)
+	if err != nil {
+		log.Println(err)
+		return st, err
+	}
+	st.MinPrice = minPrice.Float64
+	st.MaxPrice = maxPrice.Float64
+	st.OnSaleCount = int(onSale.Int64)
+
+	rows, err := s.db.Query(
+		"SELECT DISTINCT p.brand FROM category_product cp "+
+			"JOIN products p ON p.id = cp.product_id "+
+			"WHERE cp.category_id = ? AND p.deleted_at IS NULL "+
+			"AND p.brand <> '' ORDER BY p.brand",
+		c.ID)
+	if err != nil {
+		log.Println(err)
+		return st, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var brand string
+		err := rows.Scan(&brand)
+		if err != nil {
+			log.Println(err)
+			return st, err
+		}
+		st.Brands = append(st.Brands, brand)
+	}
+	return st, rows.Err()
+}
+
+// formatPrice leaves out the decimals of whole prices.
+func formatPrice(price float64) string {
+	if price == math.Trunc(price) {
+		return strconv.FormatFloat(price, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(price, 'f', 2, 64)
+}
+
+// renderDescription fills in the placeholders of a category description.
+// Unknown placeholders are left as they are.
+func renderDescription(description string, st categorystats) string {
+	if !strings.Contains(description, "{{") {
+		return description
+	}
+	return strings.NewReplacer(
+		"{{count}}", strconv.Itoa(st.ProductCount),
+		"{{min_price}}", formatPrice(st.MinPrice),
+		"{{max_price}}", formatPrice(st.MaxPrice),
+		"{{on_sale_count}}", strconv.Itoa(st.OnSaleCount),
+		"{{brands}}", strings.Join(st.Brands, ", "),
+		"{{brand_count}}", strconv.Itoa(len(st.Brands)),
+	).Replace(description)
+}
+
+// saveStats stores the stats of c and its description rendered with them.
+func (c *category) saveStats(s *session) error {
+	st, err := c.selectStats(s)
+	if err != nil {
+		return err
+	}
+
+	brands, err := json.Marshal(st.Brands)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"INSERT INTO category_stats (category_id, product_count, min_price, "+
+			"max_price, on_sale_count, brands, created_at, updated_at) "+
+			"VALUES (?,?,?,?,?,?,now(),now()) ON DUPLICATE KEY UPDATE "+
+			"product_count = VALUES(product_count), min_price = VALUES(min_price), "+
+			"max_price = VALUES(max_price), on_sale_count = VALUES(on_sale_count), "+
+			"brands = VALUES(brands), updated_at = now()",
+		c.ID, st.ProductCount, st.MinPrice, st.MaxPrice, st.OnSaleCount, string(brands))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	_, err = s.db.Exec(
+		"UPDATE categories SET rendered_description = ? WHERE id = ?",
+		renderDescription(c.Description, st), c.ID)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
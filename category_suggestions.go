@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+)
+
+const SUGGESTION_PENDING = "pending"
+const SUGGESTION_ACCEPTED = "accepted"
+const SUGGESTION_REJECTED = "rejected"
+
+// suggestionsPerProduct is the most categories suggested for one product.
+const suggestionsPerProduct = 3
+
+// minSuggestionConfidence drops suggestions the classifier is unsure of.
+const minSuggestionConfidence = 0.2
+
+// minTrainingProducts is the number of products a category needs before
+// it is suggested.
+const minTrainingProducts = 5
+
+// suggestion is a category proposed for an uncategorised product.
+type suggestion struct {
+	ID           int     `json:"id"`
+	ProductID    int     `json:"product_id"`
+	ProductName  string  `json:"product_name"`
+	CategoryID   int     `json:"category_id"`
+	CategoryName string  `json:"category_name"`
+	Confidence   float64 `json:"confidence"`
+	Status       string  `json:"status"`
+}
+
+// classifier is a multinomial naive Bayes model over the stemmed words of
+// the products attached to each category.
+type classifier struct {
+	documents  int
+	vocabulary map[string]bool
+	classes    map[int]*classifierclass
+}
+
+type classifierclass struct {
+	documents int
+	words     int
+	counts    map[string]int
+}
+
+// scoredcategory is a category with the probability that a product
+// belongs to it.
+type scoredcategory struct {
+	CategoryID int
+	Confidence float64
+}
+
+// classifierWords returns the words a product is classified by. The name
+// is counted twice since it describes the product better than the
+// description does.
+func (s *session) classifierWords(p product) []string {
+	words := append([]string{}, s.searchDocument(p).Stems...)
+	return append(words, stems(tokenise(p.Name+" "+p.NameByUser))...)
+}
+
+// train builds a classifier from the category memberships of the site.
+func (s *session) train() (*classifier, error) {
+	cl := &classifier{vocabulary: make(map[string]bool), classes: make(map[int]*classifierclass)}
+
+	products, err := s.selectSiteProducts()
+	if err != nil {
+		return cl, err
+	}
+	byID := make(map[int]product)
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+
+	rows, err := s.db.Query(
+		"SELECT cp.category_id, cp.product_id FROM category_product cp "+
+			"JOIN categories c ON c.id = cp.category_id "+
+			"WHERE c.site_id = ? AND c.deleted_at IS NULL",
+		s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return cl, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var categoryID, productID int
+		err := rows.Scan(&categoryID, &productID)
+		if err != nil {
+			log.Println(err)
+			return cl, err
+		}
+		p, ok := byID[productID]
+		if !ok || p.isDeleted() {
+			continue
+		}
+
+		class, ok := cl.classes[categoryID]
+		if !ok {
+			class = &classifierclass{counts: make(map[string]int)}
+			cl.classes[categoryID] = class
+		}
+		class.documents++
+		cl.documents++
+		for _, w := range s.classifierWords(p) {
+			class.counts[w]++
+			class.words++
+			cl.vocabulary[w] = true
+		}
+	}
+
+	for id, class := range cl.classes {
+		if class.documents < minTrainingProducts {
+			cl.documents -= class.documents
+			delete(cl.classes, id)
+		}
+	}
+	return cl, rows.Err()
+}
+
+// classify returns the categories of the model, most probable first. The
+// confidences of all categories add up to one.
+func (cl *classifier) classify(words []string) []scoredcategory {
+	scores := []scoredcategory{}
+	if len(cl.classes) == 0 {
+		return scores
+	}
+
+	vocabulary := float64(len(cl.vocabulary))
+	max := math.Inf(-1)
+	for id, class := range cl.classes {
+		score := math.Log(float64(class.documents) / float64(cl.documents))
+		for _, w := range words {
+			if !cl.vocabulary[w] {
+				continue
+			}
+			score += math.Log((float64(class.counts[w]) + 1) / (float64(class.words) + vocabulary))
+		}
+		if score > max {
+			max = score
+		}
+		scores = append(scores, scoredcategory{CategoryID: id, Confidence: score})
+	}
+
+	// Turn log probabilities into probabilities without underflowing.
+	sum := 0.0
+	for i := range scores {
+		scores[i].Confidence = math.Exp(scores[i].Confidence - max)
+		sum += scores[i].Confidence
+	}
+	for i := range scores {
+		scores[i].Confidence /= sum
+	}
+
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Confidence != scores[j].Confidence {
+			return scores[i].Confidence > scores[j].Confidence
+		}
+		return scores[i].CategoryID < scores[j].CategoryID
+	})
+	return scores
+}
+
+// suggestCategories replaces the pending suggestions of the site with new
+// ones for every live product without categories. Suggestions editors
+// accepted or rejected are kept and not made again.
+func (s *session) suggestCategories() (int, error) {
+	cl, err := s.train()
+	if err != nil {
+		return 0, err
+	}
+	products, err := s.selectSiteProducts()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.db.Exec(
+		"DELETE FROM category_suggestions WHERE site_id = ? AND status = ?",
+		s.site.ID, SUGGESTION_PENDING)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+
+	count := 0
+	for _, p := range products {
+		if s.ctx.Err() != nil {
+			return count, s.ctx.Err()
+		}
+		if p.HasCategories || p.isDeleted() {
+			continue
+		}
+
+		scores := cl.classify(s.classifierWords(p))
+		for i, score := range scores {
+			if i == suggestionsPerProduct || score.Confidence < minSuggestionConfidence {
+				break
+			}
+			res, err := s.db.Exec(
+				"INSERT IGNORE INTO category_suggestions (site_id, product_id, "+
+					"category_id, confidence, status, created_at, updated_at) "+
+					"VALUES (?,?,?,?,?,now(),now())",
+				s.site.ID, p.ID, score.CategoryID, score.Confidence, SUGGESTION_PENDING)
+			if err != nil {
+				log.Println(err)
+				return count, err
+			}
+			n, _ := res.RowsAffected()
+			count += int(n)
+		}
+	}
+	return count, nil
+}
+
+// selectSuggestions lists the pending suggestions of the site, most
+// confident first. A productID above zero limits them to that product.
+func (s *session) selectSuggestions(productID int, limit int) ([]suggestion, error) {
+	suggestions := []suggestion{}
+	rows, err := s.db.Query(
+		"SELECT cs.id, cs.product_id, p.name, cs.category_id, c.name, "+
+			"cs.confidence, cs.status FROM category_suggestions cs "+
+			"JOIN products p ON p.id = cs.product_id "+
+			"JOIN categories c ON c.id = cs.category_id "+
+			"WHERE cs.site_id = ? AND cs.status = ? AND (? = 0 OR cs.product_id = ?) "+
+			"AND c.deleted_at IS NULL ORDER BY cs.confidence DESC, cs.id LIMIT ?",
+		s.site.ID, SUGGESTION_PENDING, productID, productID, limit)
+	if err != nil {
+		log.Println(err)
+		return suggestions, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		sg := suggestion{}
+		err := rows.Scan(&sg.ID, &sg.ProductID, &sg.ProductName, &sg.CategoryID,
+			&sg.CategoryName, &sg.Confidence, &sg.Status)
+		if err != nil {
+			log.Println(err)
+			return suggestions, err
+		}
+		suggestions = append(suggestions, sg)
+	}
+	return suggestions, rows.Err()
+}
+
+// selectSuggestion loads a suggestion of the site.
+func (s *session) selectSuggestion(id int) (suggestion, error) {
+	sg := suggestion{}
+	err := s.db.QueryRow(
+		"SELECT id, product_id, category_id, confidence, status "+
+			"FROM category_suggestions WHERE id = ? AND site_id = ?",
+		id, s.site.ID).Scan(&sg.ID, &sg.ProductID, &sg.CategoryID, &sg.Confidence, &sg.Status)
+	if err != nil {
+		log.Println(err)
+		return sg, errors.New("Suggestion not found.")
+	}
+	return sg, nil
+}
+
+// accept includes the product in the suggested category, the same way an
+// editor including it by hand would.
+func (sg *suggestion) accept(s *session) error {
+	_, err := s.selectCategories()
+	if err != nil {
+		return err
+	}
+	c, ok := s.categoriesByID()[sg.CategoryID]
+	if !ok {
+		return errors.New("Category not found.")
+	}
+	products, err := s.selectSiteProducts()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range products {
+		if p.ID == sg.ProductID {
+			_, err = c.setMembership(s, p, MEMBERSHIP_INCLUDE)
+			if err != nil {
+				return err
+			}
+			return sg.setStatus(s, SUGGESTION_ACCEPTED)
+		}
+	}
+	return errors.New("Product not found.")
+}
+
+// reject keeps the suggestion from being made again.
+func (sg *suggestion) reject(s *session) error {
+	return sg.setStatus(s, SUGGESTION_REJECTED)
+}
+
+func (sg *suggestion) setStatus(s *session, status string) error {
+	_, err := s.db.Exec(
+		"UPDATE category_suggestions SET status = ?, updated_at = now() WHERE id = ?",
+		status, sg.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	sg.Status = status
+	return nil
+}
+
+// suggest regenerates the category suggestions of the site.
+func (s *session) suggest() {
+	defer s.db.Close()
+
+	count, err := s.suggestCategories()
+	if err != nil {
+		log.Println(err)
+		s.job.fail(err)
+	}
+	log.Printf("Suggested %d categories for %s.", count, s.site.Name)
+}
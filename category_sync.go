@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// changedProductsChunk limits the number of ids in one IN () list.
+const changedProductsChunk = 500
+
+// changeset collects the ids of the products a run inserted, updated or
+// deleted. The workers add to it concurrently.
+type changeset struct {
+	mutex    sync.Mutex
+	products map[int]bool
+}
+
+func newChangeset() *changeset {
+	return &changeset{products: make(map[int]bool)}
+}
+
+func (c *changeset) add(id int) {
+	if c == nil || id == 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.products[id] = true
+}
+
+// ids returns the changed product ids in ascending order.
+func (c *changeset) ids() []int {
+	ids := []int{}
+	if c == nil {
+		return ids
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id := range c.products {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// rulesHash sums up everything that decides which products c matches: its
+// search string, rules, merchant category mappings and, if c includes its
+// subcategories, the hashes of its descendants. It is empty if the
+// mappings could not be loaded.
+func (s *session) rulesHash(c *category) string {
+	return s.rulesHashVisiting(c, map[int]bool{})
+}
+
+func (s *session) rulesHashVisiting(c *category, visited map[int]bool) string {
+	mappings, err := s.selectCategoryMappings()
+	if err != nil {
+		return ""
+	}
+	visited[c.ID] = true
+
+	parts := []string{
+		c.Search,
+		c.Rules.String(),
+		strconv.FormatBool(c.IncludeSubcategories),
+	}
+
+	own := []string{}
+	for _, m := range mappings {
+		if m.CategoryID == c.ID {
+			own = append(own, fmt.Sprintf("%d:%d:%s", m.FeedID, m.NetworkID, m.MerchantCategory))
+		}
+	}
+	sort.Strings(own)
+	parts = append(parts, strings.Join(own, "\n"))
+
+	if c.IncludeSubcategories {
+		children := s.subcategories(c)
+		sort.Slice(children, func(i, j int) bool { return children[i].ID < children[j].ID })
+		for _, child := range children {
+			if visited[child.ID] {
+				continue
+			}
+			hash := s.rulesHashVisiting(child, visited)
+			if hash == "" {
+				return ""
+			}
+			parts = append(parts, strconv.Itoa(child.ID)+":"+hash)
+		}
+	}
+
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// needsFullSync reports whether c has to be compared with every product of
+// the site rather than only the changed ones. Sessions without a change
+// set, those of a refresh, sync everything. Sessions limited to changed
+// products leave categories with new rules for a later full sync.
+func (s *session) needsFullSync(c *category) bool {
+	if s.changes == nil {
+		return true
+	}
+	if s.changedOnly {
+		return false
+	}
+	hash := s.rulesHash(c)
+	return hash == "" || hash != c.SyncedHash
+}
+
+// splitCategorySync divides the categories into those that need a full
+// sync and those that only need their changed products re-evaluated.
+func (s *session) splitCategorySync(categories []categoryinterface) ([]categoryinterface, []*category) {
+	full := []categoryinterface{}
+	changed := []*category{}
+	for _, ci := range categories {
+		c, ok := ci.(*category)
+		if !ok || s.needsFullSync(c) {
+			full = append(full, ci)
+		} else {
+			changed = append(changed, c)
+		}
+	}
+	return full, changed
+}
+
+// saveSyncedHash records the rules c was last fully synced with.
+func (c *category) saveSyncedHash(s *session) error {
+	hash := s.rulesHash(c)
+	if hash == "" {
+		return nil
+	}
+	_, err := s.db.Exec("UPDATE categories SET synced_hash = ? WHERE id = ?", hash, c.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	c.SyncedHash = hash
+	return nil
+}
+
+// selectChangedProducts loads the products of the change set, their
+// category memberships and the categories they are excluded from.
+func (s *session) selectChangedProducts() error {
+	s.changedProducts = []product{}
+	s.changedRelations = make(map[int]map[int]categoryproduct)
+	s.changedExclusions = make(map[int]map[int]bool)
+
+	ids := s.changes.ids()
+	for start := 0; start < len(ids); start += changedProductsChunk {
+		end := start + changedProductsChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+		args := make([]interface{}, len(chunk)+1)
+		args[0] = s.site.ID
+		for i, id := range chunk {
+			args[i+1] = id
+		}
+		in := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+
+		rows, err := s.db.Query(
+			"SELECT "+siteProductColumns+" FROM products "+
+				"WHERE site_id = ? AND id IN ("+in+")", args...)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		for rows.Next() {
+			p, err := scanSiteProduct(rows)
+			if err != nil {
+				rows.Close()
+				log.Println(err)
+				return err
+			}
+			s.changedProducts = append(s.changedProducts, p)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		rows, err = s.db.Query(
+			"SELECT id, category_id, product_id, forced "+
+				"FROM category_product WHERE product_id IN ("+in+")", args[1:]...)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		for rows.Next() {
+			cp := categoryproduct{}
+			err := rows.Scan(&cp.ID, &cp.CategoryID, &cp.ProductID, &cp.Forced)
+			if err != nil {
+				rows.Close()
+				log.Println(err)
+				return err
+			}
+			if s.changedRelations[cp.CategoryID] == nil {
+				s.changedRelations[cp.CategoryID] = make(map[int]categoryproduct)
+			}
+			s.changedRelations[cp.CategoryID][cp.ProductID] = cp
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		rows, err = s.db.Query(
+			"SELECT category_id, product_id FROM category_product_exclusions "+
+				"WHERE product_id IN ("+in+")", args[1:]...)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		for rows.Next() {
+			var categoryID, productID int
+			err := rows.Scan(&categoryID, &productID)
+			if err != nil {
+				rows.Close()
+				log.Println(err)
+				return err
+			}
+			if s.changedExclusions[categoryID] == nil {
+				s.changedExclusions[categoryID] = make(map[int]bool)
+			}
+			s.changedExclusions[categoryID][productID] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// syncChangedProducts attaches and detaches the changed products of the
+// session the way a full sync of c would, without looking at the rest of
+// the site.
+func (c *category) syncChangedProducts(s *session) error {
+	matched := make(map[int]bool)
+	for _, p := range c.treeMatches(s, s.changedProducts) {
+		matched[p.ID] = true
+	}
+
+	var err error
+	touched := false
+	current := s.changedRelations[c.ID]
+	excluded := s.changedExclusions[c.ID]
+	for _, p := range s.changedProducts {
+		if s.ctx.Err() != nil {
+			err = s.ctx.Err()
+			break
+		}
+		cp, attached := current[p.ID]
+		if (matched[p.ID] && !excluded[p.ID]) || attached {
+			touched = true
+		}
+
+		var changeErr error
+		if matched[p.ID] && !attached && !excluded[p.ID] {
+			changeErr = p.attachCategory(s, c)
+		} else if !matched[p.ID] && attached && !cp.Forced {
+			cp.category = *c
+			changeErr = p.detachCategory(s, cp)
+		}
+		if err == nil {
+			err = changeErr
+		}
+	}
+
+	// Prices and brands of member products may have changed without a
+	// change of membership. Categories no changed product belongs to keep
+	// their stats.
+	if touched && s.ctx.Err() == nil {
+		statsErr := c.saveStats(s)
+		if err == nil {
+			err = statsErr
+		}
+	}
+
+	s.CategoryDone <- categorymessage{category: c, err: nil, action: "syncChangedProducts"}
+	return err
+}
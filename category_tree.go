@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// categorynode is a category in the tree returned over the API.
+type categorynode struct {
+	ID                   int             `json:"id"`
+	ParentID             int             `json:"parent_id,omitempty"`
+	Name                 string          `json:"name"`
+	Slug                 string          `json:"slug"`
+	Path                 string          `json:"path"`
+	IncludeSubcategories bool            `json:"include_subcategories"`
+	Children             []*categorynode `json:"children"`
+}
+
+// categoriesByID indexes the selected categories of the session.
+func (s *session) categoriesByID() map[int]*category {
+	byID := make(map[int]*category)
+	for _, ci := range s.categories {
+		if c, ok := ci.(*category); ok {
+			byID[c.ID] = c
+		}
+	}
+	return byID
+}
+
+// categoryAncestors returns the ancestors of c, parent first. It fails if
+// the parents of c form a cycle or a parent does not exist.
+func categoryAncestors(byID map[int]*category, c *category) ([]*category, error) {
+	ancestors := []*category{}
+	seen := map[int]bool{c.ID: true}
+	for id := c.ParentID; id != 0; {
+		if seen[id] {
+			return ancestors, errors.New("Category " + c.Name + " is its own ancestor.")
+		}
+		parent, ok := byID[id]
+		if !ok {
+			return ancestors, errors.New("Parent " + strconv.Itoa(id) + " of category " + c.Name + " does not exist.")
+		}
+		seen[id] = true
+		ancestors = append(ancestors, parent)
+		id = parent.ParentID
+	}
+	return ancestors, nil
+}
+
+// validateParent checks that making parentID the parent of the category
+// with the given id keeps the tree free of cycles.
+func (s *session) validateParent(id int, parentID int) error {
+	if parentID == 0 {
+		return nil
+	}
+	if parentID == id {
+		return errors.New("A category cannot be its own parent.")
+	}
+
+	byID := s.categoriesByID()
+	parent, ok := byID[parentID]
+	if !ok {
+		return errors.New("Parent category not found.")
+	}
+	ancestors, err := categoryAncestors(byID, parent)
+	if err != nil {
+		return err
+	}
+	for _, a := range ancestors {
+		if a.ID == id {
+			return errors.New("Parent category is a subcategory of this category.")
+		}
+	}
+	return nil
+}
+
+// categoryPath returns the slug path of c, e.g. "sport/lopning/skor". A
+// category with a broken parent chain is treated as a root.
+func categoryPath(byID map[int]*category, c *category) string {
+	ancestors, err := categoryAncestors(byID, c)
+	if err != nil {
+		log.Println(err)
+		return c.Slug
+	}
+
+	slugs := []string{c.Slug}
+	for _, a := range ancestors {
+		slugs = append([]string{a.Slug}, slugs...)
+	}
+	return strings.Join(slugs, "/")
+}
+
+// subcategories returns the direct children of c.
+func (s *session) subcategories(c *category) []*category {
+	children := []*category{}
+	for _, ci := range s.categories {
+		child, ok := ci.(*category)
+		if ok && child.ParentID == c.ID && child.ID != c.ID {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// categoryMatches returns the products matching c on its own, by search
+// and rules or by a merchant category mapping. The matches are cached for
+// the session since parents reuse the matches of their subcategories.
+func (s *session) categoryMatches(c *category, products []product) []product {
+	if s.matches == nil {
+		s.matches = make(map[int][]product)
+	}
+	matches, ok := s.matches[c.ID]
+	if !ok {
+		matches = c.matchProducts(s, products)
+		seen := make(map[int]bool)
+		for _, p := range matches {
+			seen[p.ID] = true
+		}
+
+		mapped, _ := c.mappedProducts(s, products)
+		for _, p := range mapped {
+			if !seen[p.ID] {
+				matches = append(matches, p)
+			}
+		}
+		s.matches[c.ID] = matches
+	}
+	return matches
+}
+
+// updateCategoryPaths stores the slug path of every category whose path
+// changed.
+func (s *session) updateCategoryPaths() error {
+	byID := s.categoriesByID()
+	for _, c := range byID {
+		path := categoryPath(byID, c)
+		if path == c.Path {
+			continue
+		}
+		_, err := s.db.Exec("UPDATE categories SET path = ? WHERE id = ?", path, c.ID)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		c.Path = path
+	}
+	return nil
+}
+
+// categoryTree returns the categories of the site as a tree. Categories
+// caught in a parent cycle are listed as roots.
+func (s *session) categoryTree() []*categorynode {
+	byID := s.categoriesByID()
+	nodes := make(map[int]*categorynode)
+	for _, ci := range s.categories {
+		c, ok := ci.(*category)
+		if !ok {
+			continue
+		}
+		nodes[c.ID] = &categorynode{
+			ID:                   c.ID,
+			ParentID:             c.ParentID,
+			Name:                 c.Name,
+			Slug:                 c.Slug,
+			Path:                 categoryPath(byID, c),
+			IncludeSubcategories: c.IncludeSubcategories,
+			Children:             []*categorynode{},
+		}
+	}
+
+	roots := []*categorynode{}
+	for _, ci := range s.categories {
+		c, ok := ci.(*category)
+		if !ok {
+			continue
+		}
+		_, err := categoryAncestors(byID, c)
+		if c.ParentID == 0 || err != nil {
+			roots = append(roots, nodes[c.ID])
+		} else {
+			parent := nodes[c.ParentID]
+			parent.Children = append(parent.Children, nodes[c.ID])
+		}
+	}
+	return roots
+}
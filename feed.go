@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type feedmessage struct {
@@ -22,6 +26,9 @@ type feed struct {
 	NetworkID             int
 	Network               networkinterface
 	AllowEmptyDescription bool
+	IdentityStrategy      string
+	Rules                 validationrules
+	Rejections            []rejection
 	FeedData              []byte
 	Products              map[string]product
 	ProductsCount         int
@@ -42,70 +49,114 @@ func (f feed) String() (s string) {
 }
 
 func (f *feed) update(s *session) {
-	err := f.fetch()
+	s.job.feedStarted(f)
+	start := time.Now()
+	err := f.fetch(s.ctx)
 	if err != nil {
-		log.Println(err)
-		s.FeedError <- feedmessage{feed: f, err: err, action: "update"}
+		f.failed(s, err)
 		return
 	}
-
-	err = f.parse()
+	feedFetchDuration.WithLabelValues(f.label()).Observe(time.Since(start).Seconds())
+	feedFetchBytes.WithLabelValues(f.label()).Observe(float64(len(f.FeedData)))
+	s.job.feedFetched(f)
+	s.job.stageCompleted("feed " + f.Name + " fetched")
+
+	start = time.Now()
+	err = f.parse(s)
+	s.job.feedParsed(f)
+	if err == nil {
+		feedParseDuration.WithLabelValues(f.label()).Observe(time.Since(start).Seconds())
+		feedParsedProducts.WithLabelValues(f.label()).Set(float64(len(f.Products)))
+	}
+	if err == nil {
+		err = s.ctx.Err()
+	}
 	if err != nil {
-		log.Println(err)
-		s.FeedError <- feedmessage{feed: f, err: err, action: "update"}
+		f.failed(s, err)
 		return
 	}
+	s.job.stageCompleted("feed " + f.Name + " parsed")
 
-	f.DBOperationDone = make(chan string, len(f.Products))
-	f.DBOperationError = make(chan error, len(f.Products))
+	f.Rules, err = f.selectValidationRules(s)
+	if err != nil {
+		f.failed(s, err)
+		return
+	}
 
 	err = f.syncProducts(s)
 	if err != nil {
-		log.Println(err)
-		s.FeedError <- feedmessage{feed: f, err: err, action: "update"}
+		f.failed(s, err)
 		return
 	}
 
 	log.Println("Synced " + strconv.Itoa(f.ProductsCount) + " products")
 
+	writeErrors := 0
 	for i := 1; i < f.ProductsCount+1; i++ {
 		select {
 		case result := <-f.DBOperationDone:
 			log.Println(result)
 		case err := <-f.DBOperationError:
 			log.Println(err)
+			writeErrors++
+		case <-s.ctx.Done():
+			f.failed(s, s.ctx.Err())
+			return
 		}
 		log.Println("Updated " + strconv.Itoa(i) + "/" + strconv.Itoa(f.ProductsCount))
+		s.job.feedProgress(f, i, f.ProductsCount)
+	}
+	if writeErrors > 0 {
+		f.failed(s, errors.New(strconv.Itoa(writeErrors)+" of "+
+			strconv.Itoa(f.ProductsCount)+" products could not be written."))
+		return
 	}
+	s.job.stageCompleted("feed " + f.Name + " written")
 
+	s.job.feedFinished(f, nil)
 	s.FeedDone <- feedmessage{feed: f, err: nil, action: "update"}
 }
 
+// failed reports that the update of the feed stopped with err.
+func (f *feed) failed(s *session, err error) {
+	log.Println(err)
+	s.job.feedFinished(f, err)
+	s.FeedError <- feedmessage{feed: f, err: err, action: "update"}
+}
+
 // fetch downloads the feed data
-func (f *feed) fetch() error {
+func (f *feed) fetch(ctx context.Context) error {
 	// timeout := time.Duration(20 * time.Second)
 	// client := http.Client{
 	// 	Timeout: timeout,
 	// }
-	resp, err := http.Get(f.URL)
+	req, err := http.NewRequestWithContext(ctx, "GET", f.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	log.Println(resp.Body)
-	f.FeedData, _ = ioutil.ReadAll(resp.Body)
-	return nil
+	f.FeedData, err = ioutil.ReadAll(resp.Body)
+	return err
 }
 
-func (f *feed) parse() error {
+func (f *feed) parse(s *session) error {
 	var err error
 
 	products, err := f.Network.parseProducts(f)
 	if err == nil {
 		f.Products = make(map[string]product)
 		for i, _ := range products {
-			if products[i].GraphicURL != "" {
-				f.Products[products[i].Identifier] = products[i]
+			products[i].normalise(s.site)
+			key := products[i].identity(f.IdentityStrategy)
+			if key == "" {
+				f.reject(products[i], 0, []string{"no SKU, EAN or URL to identify it by"})
+			} else {
+				f.Products[key] = products[i]
 			}
 		}
 	}
@@ -158,10 +209,12 @@ func (f feed) selectProducts(s *session) (map[string]product, error) {
 			&p.FeedID,
 			&p.Name,
 			&p.NameByUser,
+			&p.Slug,
 			&p.Identifier,
 			&p.Price,
 			&p.RegularPrice,
 			&p.Description,
+			&p.DescriptionText,
 			&p.DescriptionByUser,
 			&p.Currency,
 			&p.ProductURL,
@@ -171,14 +224,28 @@ func (f feed) selectProducts(s *session) (map[string]product, error) {
 			&p.Points,
 			&p.HasCategories,
 			&p.Active,
+			&p.EAN,
+			&p.MPN,
+			&p.Brand,
+			&p.MerchantCategory,
 			&p.DeletedAt,
 		)
 		if err != nil {
 			log.Println(err)
 			return products, err
-		} else {
-			products[p.Identifier] = p
 		}
+
+		// Duplicates left behind by earlier identity schemes are kept under
+		// their id so they get cleaned up as no longer in the feed.
+		key := p.identity(f.IdentityStrategy)
+		if d, ok := products[key]; ok {
+			if d.isDeleted() == false || p.isDeleted() == true {
+				key = "id:" + strconv.Itoa(p.ID)
+			} else {
+				products["id:"+strconv.Itoa(d.ID)] = d
+			}
+		}
+		products[key] = p
 	}
 
 	err = rows.Err()
@@ -194,70 +261,111 @@ func (f *feed) syncProducts(s *session) error {
 		log.Println(err)
 		return err
 	} else {
+		// Deleted products are written too, so the results can outnumber
+		// the products of the feed.
+		f.DBOperationDone = make(chan string, len(f.Products)+len(dbProducts))
+		f.DBOperationError = make(chan error, len(f.Products)+len(dbProducts))
+
 		// Check if product exists in DB, update or insert appropriately
+		matches := f.matchProducts(dbProducts)
 		for k, p := range f.Products {
-			_, ok := dbProducts[k]
+			dbKey, ok := matches[k]
+
+			reasons := p.validate(f.Rules)
+			if len(reasons) > 0 {
+				f.reject(p, dbProducts[dbKey].ID, reasons)
+				if ok && dbProducts[dbKey].isDeleted() == false && f.Rules.InvalidAction == INVALID_DEACTIVATE {
+					d := dbProducts[dbKey]
+					d.DBAction = DBACTION_DELETE
+					err = f.queueProduct(s, d)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
 			if ok {
-				p.ID = dbProducts[k].ID
+				p.ID = dbProducts[dbKey].ID
 
-				if dbProducts[k].isDeleted() == true {
-					log.Println(dbProducts[k].Name + " reactivated!")
+				if dbProducts[dbKey].isDeleted() == true {
+					log.Println(dbProducts[dbKey].Name + " reactivated!")
 					p.DBAction = DBACTION_UPDATE
 				}
 
-				if dbProducts[k].isDeleted() == false && p.Description == "" && f.AllowEmptyDescription == false {
-					p.DBAction = DBACTION_DELETE
-				} else {
-					if dbProducts[k].Name != p.Name {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " updated: " + p.Name)
-						p.DBAction = DBACTION_UPDATE
-					}
+				// The slug only follows the feed name while editors have not
+				// named the product themselves.
+				slug := p.Slug
+				p.Slug = dbProducts[dbKey].Slug
+				if dbProducts[dbKey].Name != p.Name {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " updated: " + p.Name)
+					p.DBAction = DBACTION_UPDATE
 
-					if dbProducts[k].Identifier != p.Identifier {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " identifier (" + dbProducts[k].Identifier + ") updated: " + p.Identifier)
-						p.DBAction = DBACTION_UPDATE
+					if dbProducts[dbKey].NameByUser == "" && generateSlug(dbProducts[dbKey].Name) != slug {
+						p.PreviousSlug = dbProducts[dbKey].Slug
+						p.Slug = slug
 					}
+				}
 
-					if dbProducts[k].Description != p.Description {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " description (" + dbProducts[k].Description + ") updated: " + p.Description)
-						p.DBAction = DBACTION_UPDATE
-					}
+				if dbProducts[dbKey].Identifier != p.Identifier {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " identifier (" + dbProducts[dbKey].Identifier + ") updated: " + p.Identifier)
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if strconv.FormatFloat(dbProducts[k].Price, 'f', 2, 64) != strconv.FormatFloat(p.Price, 'f', 2, 64) {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " price (" + strconv.FormatFloat(dbProducts[k].Price, 'f', 2, 64) + ") updated: " + strconv.FormatFloat(p.Price, 'f', 2, 64))
-						p.DBAction = DBACTION_UPDATE
-					}
+				if dbProducts[dbKey].Description != p.Description {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " description (" + dbProducts[dbKey].Description + ") updated: " + p.Description)
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if strconv.FormatFloat(dbProducts[k].RegularPrice, 'f', 2, 64) != strconv.FormatFloat(p.RegularPrice, 'f', 2, 64) {
-						log.Println(dbProducts[k].RegularPrice, p.RegularPrice)
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " regular price (" + strconv.FormatFloat(dbProducts[k].RegularPrice, 'f', 2, 64) + ") updated: " + strconv.FormatFloat(p.RegularPrice, 'f', 2, 64))
-						p.DBAction = DBACTION_UPDATE
-					}
+				if dbProducts[dbKey].DescriptionText != p.DescriptionText {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " plain text description updated")
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if dbProducts[k].Currency != p.Currency {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " currency (" + dbProducts[k].Currency + ") updated: " + p.Currency)
-						p.DBAction = DBACTION_UPDATE
-					}
+				if strconv.FormatFloat(dbProducts[dbKey].Price, 'f', 2, 64) != strconv.FormatFloat(p.Price, 'f', 2, 64) {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " price (" + strconv.FormatFloat(dbProducts[dbKey].Price, 'f', 2, 64) + ") updated: " + strconv.FormatFloat(p.Price, 'f', 2, 64))
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if dbProducts[k].ShippingPrice != p.ShippingPrice {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " shipping price (" + strconv.FormatFloat(dbProducts[k].ShippingPrice, 'f', 2, 64) + ") updated: " + strconv.FormatFloat(p.ShippingPrice, 'f', 2, 64))
-						p.DBAction = DBACTION_UPDATE
-					}
+				if strconv.FormatFloat(dbProducts[dbKey].RegularPrice, 'f', 2, 64) != strconv.FormatFloat(p.RegularPrice, 'f', 2, 64) {
+					log.Println(dbProducts[dbKey].RegularPrice, p.RegularPrice)
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " regular price (" + strconv.FormatFloat(dbProducts[dbKey].RegularPrice, 'f', 2, 64) + ") updated: " + strconv.FormatFloat(p.RegularPrice, 'f', 2, 64))
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if dbProducts[k].InStock != p.InStock {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " in stock (" + strconv.FormatBool(dbProducts[k].InStock) + ") updated: " + strconv.FormatBool(p.InStock))
-						p.DBAction = DBACTION_UPDATE
-					}
+				if dbProducts[dbKey].Currency != p.Currency {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " currency (" + dbProducts[dbKey].Currency + ") updated: " + p.Currency)
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if dbProducts[k].ProductURL != p.ProductURL {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " product URL (" + dbProducts[k].ProductURL + ") updated: " + p.ProductURL)
-						p.DBAction = DBACTION_UPDATE
-					}
+				if dbProducts[dbKey].ShippingPrice != p.ShippingPrice {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " shipping price (" + strconv.FormatFloat(dbProducts[dbKey].ShippingPrice, 'f', 2, 64) + ") updated: " + strconv.FormatFloat(p.ShippingPrice, 'f', 2, 64))
+					p.DBAction = DBACTION_UPDATE
+				}
 
-					if dbProducts[k].GraphicURL != p.GraphicURL {
-						log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[k].Name + " graphic URL (" + dbProducts[k].GraphicURL + ") updated: " + p.GraphicURL)
-						p.DBAction = DBACTION_UPDATE
-					}
+				if dbProducts[dbKey].InStock != p.InStock {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " in stock (" + strconv.FormatBool(dbProducts[dbKey].InStock) + ") updated: " + strconv.FormatBool(p.InStock))
+					p.DBAction = DBACTION_UPDATE
+				}
+
+				if dbProducts[dbKey].ProductURL != p.ProductURL {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " product URL (" + dbProducts[dbKey].ProductURL + ") updated: " + p.ProductURL)
+					p.DBAction = DBACTION_UPDATE
+				}
+
+				if dbProducts[dbKey].EAN != p.EAN || dbProducts[dbKey].MPN != p.MPN || dbProducts[dbKey].Brand != p.Brand {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " EAN/MPN/brand updated: " + p.EAN + " " + p.MPN + " " + p.Brand)
+					p.DBAction = DBACTION_UPDATE
+				}
+
+				if dbProducts[dbKey].MerchantCategory != p.MerchantCategory {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " merchant category (" + dbProducts[dbKey].MerchantCategory + ") updated: " + p.MerchantCategory)
+					p.DBAction = DBACTION_UPDATE
+				}
+
+				if dbProducts[dbKey].GraphicURL != p.GraphicURL {
+					log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + dbProducts[dbKey].Name + " graphic URL (" + dbProducts[dbKey].GraphicURL + ") updated: " + p.GraphicURL)
+					p.DBAction = DBACTION_UPDATE
 				}
 
 			} else {
@@ -265,27 +373,57 @@ func (f *feed) syncProducts(s *session) error {
 			}
 
 			if p.DBAction > 0 {
-				p.FeedID = f.ID
-				p.SiteID = f.SiteID
-				m := message{feed: f, product: p}
-				f.ProductsCount++
-				s.DBOperation <- m
+				err = f.queueProduct(s, p)
+				if err != nil {
+					return err
+				}
 			}
 		}
 
+		matched := make(map[string]bool)
+		for _, dbKey := range matches {
+			matched[dbKey] = true
+		}
+
 		// Check if DBProduct no longer exists in feed, delete
 		for k, p := range dbProducts {
-			_, ok := f.Products[k]
-			if !ok && p.isDeleted() == false {
+			if !matched[k] && p.isDeleted() == false {
 				p.DBAction = DBACTION_DELETE
-
-				p.SiteID = f.SiteID
-				m := message{feed: f, product: p}
-				f.ProductsCount++
-				s.DBOperation <- m
+				err = f.queueProduct(s, p)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
 
-	return nil
+	err = f.saveRejections(s)
+	return err
+}
+
+// queueProduct hands p to the session workers. It fails once the session
+// is cancelled.
+func (f *feed) queueProduct(s *session, p product) error {
+	p.FeedID = f.ID
+	p.SiteID = f.SiteID
+	m := message{feed: f, product: p}
+	select {
+	case s.DBOperation <- m:
+		f.ProductsCount++
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// reject records that p was left out of the feed sync and why.
+func (f *feed) reject(p product, productID int, reasons []string) {
+	log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " + p.Name + " rejected: " + strings.Join(reasons, ", "))
+	f.Rejections = append(f.Rejections, rejection{
+		ProductID:  productID,
+		FeedID:     f.ID,
+		Identifier: p.Identifier,
+		Name:       p.Name,
+		Reason:     strings.Join(reasons, ", "),
+	})
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the database checks of /readyz, so that a hanging
+// database makes the probe fail instead of time out.
+const readyTimeout = 2 * time.Second
+
+// healthzHandler reports that the process is alive. It does not touch the
+// database, so a database outage does not get the process restarted.
+func healthzHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(rw, Response{Success: true, Message: "ok"})
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// readyzHandler reports whether the service can do its work: the database
+// answers and statements can be prepared on it. It reports the jobs queued
+// and running on all instances, but nothing that identifies a site, since
+// it needs no API key.
+func readyzHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+
+		var queued, running int
+		err := checkDatabase(req.Context())
+		if err == nil {
+			queued, running, err = queueDepth()
+		}
+		data := Map{
+			"database":     "ok",
+			"queued_jobs":  queued,
+			"running_jobs": running,
+		}
+
+		resp := Response{Success: true, Message: "ready", Data: data}
+		if err != nil {
+			log.Println(err)
+			data["database"] = err.Error()
+			resp.Success = false
+			resp.Message = "Database unavailable."
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// lastSuccessHandler reports the last successful run of each site, or of the
+// site asked for with site.
+func lastSuccessHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+
+		lastSuccess, err := lastSuccesses(req.FormValue("site"))
+		resp := Response{Success: true, Data: Map{"last_success": lastSuccess}}
+		if err != nil {
+			log.Println(err)
+			resp = Response{Success: false, Message: "Could not load the last successful runs."}
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// checkDatabase pings the database and prepares a statement like the ones
+// sessions prepare.
+func checkDatabase(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	err := authDB.PingContext(ctx)
+	if err != nil {
+		return err
+	}
+	stmt, err := authDB.PrepareContext(ctx, "SELECT id FROM sites WHERE subdomain = ?")
+	if err != nil {
+		return err
+	}
+	return stmt.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const IDENTITY_SKU = "sku"
+const IDENTITY_EAN = "ean"
+const IDENTITY_URL = "url"
+const IDENTITY_COMPOSITE = "composite"
+
+// identityKeys returns every key p can be recognised by. They are used as
+// fallbacks when the key of the feed's identity strategy does not match.
+func (p product) identityKeys() []string {
+	keys := []string{}
+	if p.Identifier != "" {
+		keys = append(keys, "sku:"+p.Identifier)
+	}
+	if p.EAN != "" {
+		keys = append(keys, "ean:"+p.EAN)
+	}
+	if u := normaliseProductURL(p.ProductURL); u != "" {
+		keys = append(keys, "url:"+u)
+	}
+	return keys
+}
+
+// identity returns the key p is stored under for the given strategy. If p
+// has no value for the strategy the first fallback key is used, and an
+// empty string means p cannot be identified at all.
+func (p product) identity(strategy string) string {
+	switch strategy {
+	case IDENTITY_EAN:
+		if p.EAN != "" {
+			return "ean:" + p.EAN
+		}
+	case IDENTITY_URL:
+		if u := normaliseProductURL(p.ProductURL); u != "" {
+			return "url:" + u
+		}
+	case IDENTITY_COMPOSITE:
+		if p.Identifier != "" && p.EAN != "" {
+			return "composite:" + p.Identifier + "|" + p.EAN
+		}
+	default:
+		if p.Identifier != "" {
+			return "sku:" + p.Identifier
+		}
+	}
+
+	keys := p.identityKeys()
+	if len(keys) > 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+// normaliseProductURL drops the parts of a product URL that do not identify
+// the product, so cosmetic changes are not seen as a new product.
+func normaliseProductURL(str string) string {
+	u, err := url.Parse(strings.TrimSpace(str))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	u.Scheme = "https"
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.Path = strings.TrimRight(u.Path, "/")
+	return u.String()
+}
+
+// matchProducts pairs the feed products with database products and returns
+// the database key for each matched feed key. Products are matched on
+// their identity first and then on any fallback key, so a product whose
+// SKU changed is updated rather than deleted and inserted again.
+func (f *feed) matchProducts(dbProducts map[string]product) map[string]string {
+	matches := make(map[string]string)
+	matched := make(map[string]bool)
+
+	keys := make([]string, 0, len(f.Products))
+	for k := range f.Products {
+		keys = append(keys, k)
+		if _, ok := dbProducts[k]; ok {
+			matches[k] = k
+			matched[k] = true
+		}
+	}
+	sort.Strings(keys)
+
+	// Fallback keys shared by several database products are ambiguous and
+	// are never used.
+	index := make(map[string]string)
+	ambiguous := make(map[string]bool)
+	for k, d := range dbProducts {
+		if matched[k] {
+			continue
+		}
+		for _, key := range d.identityKeys() {
+			if _, ok := index[key]; ok {
+				ambiguous[key] = true
+			}
+			index[key] = k
+		}
+	}
+
+	for _, k := range keys {
+		if _, ok := matches[k]; ok {
+			continue
+		}
+		for _, key := range f.Products[k].identityKeys() {
+			dbKey, ok := index[key]
+			if ok && !ambiguous[key] && !matched[dbKey] {
+				log.Println(f.Name + ": Site: " + strconv.Itoa(f.SiteID) + " " +
+					dbProducts[dbKey].Name + " recognised by " + key)
+				matches[k] = dbKey
+				matched[dbKey] = true
+				break
+			}
+		}
+	}
+
+	return matches
+}
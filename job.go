@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const JOB_QUEUED = "queued"
+const JOB_RUNNING = "running"
+const JOB_SUCCEEDED = "succeeded"
+const JOB_FAILED = "failed"
+const JOB_CANCELLED = "cancelled"
+
+// maxJobs is the number of finished jobs kept in memory.
+const maxJobs = 500
+
+// jobstatus is what the jobs API reports about a run.
+type jobstatus struct {
+	ID         int            `json:"id"`
+	SiteID     int            `json:"site_id"`
+	Site       string         `json:"site"`
+	Action     string         `json:"action"`
+	Priority   string         `json:"priority"`
+	APIKey     string         `json:"api_key,omitempty"`
+	State      string         `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	Attempts   int            `json:"attempts"`
+	Stages     []string       `json:"completed_stages"`
+	Feeds      []feedresult   `json:"feeds"`
+	Categories categoryresult `json:"categories"`
+	QueuedAt   time.Time      `json:"queued_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Duration   float64        `json:"duration_seconds"`
+}
+
+// feedresult is the outcome of one feed in a job.
+type feedresult struct {
+	FeedID     int        `json:"feed_id"`
+	Name       string     `json:"name"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	Parsed     int        `json:"parsed"`
+	Rejected   int        `json:"rejected"`
+	Inserted   int        `json:"inserted"`
+	Updated    int        `json:"updated"`
+	Deleted    int        `json:"deleted"`
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// categoryresult sums up the category sync of a job.
+type categoryresult struct {
+	Total      int        `json:"total"`
+	Synced     int        `json:"synced"`
+	Attached   int        `json:"attached"`
+	Detached   int        `json:"detached"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// job tracks a run of runAction. Feeds and workers report to it
+// concurrently, so the status is only read through status().
+type job struct {
+	mutex  sync.Mutex
+	ID     int
+	SiteID int
+	s      jobstatus
+	events jobevents
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobregistry holds the jobs this instance ran. Other jobs are only known
+// to the jobs table.
+type jobregistry struct {
+	mutex sync.Mutex
+	jobs  map[int]*job
+}
+
+var jobs = jobregistry{jobs: make(map[int]*job)}
+
+func now() *time.Time {
+	t := time.Now()
+	return &t
+}
+
+// add registers a job this instance claimed from the jobs table, with
+// the feeds of the session s opened for it.
+func (r *jobregistry) add(s *session, row jobrow) *job {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	j := &job{ID: row.ID, SiteID: row.SiteID}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	j.s = jobstatus{
+		ID:       j.ID,
+		SiteID:   row.SiteID,
+		Site:     row.Site,
+		Action:   row.Action,
+		Priority: row.Priority,
+		APIKey:   row.APIKey,
+		State:    JOB_QUEUED,
+		Attempts: row.Attempts,
+		Stages:   []string{},
+		Feeds:    []feedresult{},
+		QueuedAt: row.QueuedAt,
+	}
+	if row.Action == "update" {
+		for _, f := range s.feeds {
+			j.s.Feeds = append(j.s.Feeds, feedresult{FeedID: f.ID, Name: f.Name, State: JOB_QUEUED})
+		}
+	}
+	r.jobs[j.ID] = j
+	r.prune()
+	return j
+}
+
+// prune forgets the oldest finished jobs beyond maxJobs.
+func (r *jobregistry) prune() {
+	if len(r.jobs) <= maxJobs {
+		return
+	}
+	ids := []int{}
+	for id := range r.jobs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if len(r.jobs) <= maxJobs {
+			return
+		}
+		st := r.jobs[id].status()
+		if st.State == JOB_SUCCEEDED || st.State == JOB_FAILED || st.State == JOB_CANCELLED {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+func (r *jobregistry) find(id int) (*job, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	j, ok := r.jobs[id]
+	return j, ok
+}
+
+// status returns a copy of the job status that is safe to encode.
+func (j *job) status() jobstatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	st := j.s
+	st.Stages = append([]string{}, j.s.Stages...)
+	st.Feeds = append([]feedresult{}, j.s.Feeds...)
+	if st.StartedAt != nil {
+		end := time.Now()
+		if st.FinishedAt != nil {
+			end = *st.FinishedAt
+		}
+		st.Duration = end.Sub(*st.StartedAt).Seconds()
+	}
+	return st
+}
+
+// update changes the job under its lock. Sessions without a job, such as
+// those of read only handlers, are ignored.
+func (j *job) update(change func(st *jobstatus)) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	change(&j.s)
+}
+
+// updateFeed changes the result of one feed of the job.
+func (j *job) updateFeed(feedID int, change func(fr *feedresult)) {
+	j.update(func(st *jobstatus) {
+		for i := range st.Feeds {
+			if st.Feeds[i].FeedID == feedID {
+				change(&st.Feeds[i])
+				return
+			}
+		}
+	})
+}
+
+func (j *job) start() {
+	j.update(func(st *jobstatus) {
+		st.State = JOB_RUNNING
+		st.StartedAt = now()
+	})
+	j.emit(jobevent{Type: "job_started"})
+}
+
+// finish ends the job. It failed if any of its feeds failed, unless it
+// was cancelled.
+func (j *job) finish() {
+	if j == nil {
+		return
+	}
+	j.update(func(st *jobstatus) {
+		st.State = JOB_SUCCEEDED
+		for _, fr := range st.Feeds {
+			if fr.State == JOB_FAILED {
+				st.State = JOB_FAILED
+				if st.Error == "" {
+					st.Error = "Feed " + fr.Name + " failed: " + fr.Error
+				}
+			}
+		}
+		if st.Error != "" {
+			st.State = JOB_FAILED
+		}
+		if j.ctx.Err() != nil {
+			st.State = JOB_CANCELLED
+			st.Error = ""
+		}
+		st.FinishedAt = now()
+	})
+	j.cancel()
+
+	st := j.status()
+	j.emit(jobevent{Type: "job_finished", State: st.State, Error: st.Error})
+	j.closeEvents()
+}
+
+// fail records an error that is not tied to a feed.
+func (j *job) fail(err error) {
+	j.update(func(st *jobstatus) {
+		st.Error = err.Error()
+	})
+	j.emit(jobevent{Type: "error", Error: err.Error()})
+}
+
+// stopRun cancels the job. Queued jobs never start; running jobs stop at
+// the next check of their context.
+func (j *job) stopRun() error {
+	st := j.status()
+	if st.FinishedAt != nil {
+		return errors.New("Job is already " + st.State + ".")
+	}
+	j.cancel()
+	j.emit(jobevent{Type: "cancel_requested"})
+	return nil
+}
+
+// stageCompleted records a finished part of the job, so that a cancelled
+// job tells how far it got.
+func (j *job) stageCompleted(stage string) {
+	j.update(func(st *jobstatus) {
+		st.Stages = append(st.Stages, stage)
+	})
+	j.emit(jobevent{Type: "stage_completed", State: stage})
+}
+
+func (j *job) feedStarted(f *feed) {
+	j.updateFeed(f.ID, func(fr *feedresult) {
+		fr.State = JOB_RUNNING
+		fr.StartedAt = now()
+	})
+	j.emit(jobevent{Type: "feed_started", FeedID: f.ID, Feed: f.Name})
+}
+
+func (j *job) feedFetched(f *feed) {
+	j.emit(jobevent{Type: "feed_fetched", FeedID: f.ID, Feed: f.Name, Bytes: len(f.FeedData)})
+}
+
+func (j *job) feedParsed(f *feed) {
+	j.updateFeed(f.ID, func(fr *feedresult) {
+		fr.Parsed = len(f.Products)
+	})
+	j.emit(jobevent{
+		Type:     "feed_parsed",
+		FeedID:   f.ID,
+		Feed:     f.Name,
+		Total:    len(f.Products),
+		Rejected: len(f.Rejections),
+	})
+}
+
+// feedProgress reports written products of a feed. Only every percent of
+// progress is sent, so that large feeds do not flood listeners.
+func (j *job) feedProgress(f *feed, done int, total int) {
+	step := total / 100
+	if step < 1 {
+		step = 1
+	}
+	if done%step == 0 || done == total {
+		j.emit(jobevent{Type: "feed_progress", FeedID: f.ID, Feed: f.Name, Done: done, Total: total})
+	}
+}
+
+func (j *job) feedFinished(f *feed, err error) {
+	j.updateFeed(f.ID, func(fr *feedresult) {
+		fr.State = JOB_SUCCEEDED
+		if err != nil {
+			fr.State = JOB_FAILED
+			fr.Error = err.Error()
+		}
+		fr.Rejected = len(f.Rejections)
+		fr.FinishedAt = now()
+	})
+
+	ev := jobevent{Type: "feed_finished", FeedID: f.ID, Feed: f.Name, State: JOB_SUCCEEDED}
+	if err != nil {
+		ev.State = JOB_FAILED
+		ev.Error = err.Error()
+	}
+	j.emit(ev)
+}
+
+// productWritten counts a product a worker wrote for a feed.
+func (j *job) productWritten(f *feed, action int, err error) {
+	j.updateFeed(f.ID, func(fr *feedresult) {
+		switch {
+		case err != nil:
+			fr.Failed++
+		case action == DBACTION_INSERT:
+			fr.Inserted++
+		case action == DBACTION_UPDATE:
+			fr.Updated++
+		case action == DBACTION_DELETE:
+			fr.Deleted++
+		}
+	})
+}
+
+func (j *job) categoriesStarted(total int) {
+	j.update(func(st *jobstatus) {
+		st.Categories.Total = total
+		st.Categories.StartedAt = now()
+		if total == 0 {
+			st.Categories.FinishedAt = st.Categories.StartedAt
+		}
+	})
+	j.emit(jobevent{Type: "categories_started", Total: total})
+}
+
+func (j *job) categorySynced(name string, err error) {
+	done, total := 0, 0
+	j.update(func(st *jobstatus) {
+		st.Categories.Synced++
+		if st.Categories.Synced == st.Categories.Total {
+			st.Categories.FinishedAt = now()
+		}
+		done, total = st.Categories.Synced, st.Categories.Total
+	})
+
+	ev := jobevent{Type: "category_synced", Category: name, Done: done, Total: total}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	j.emit(ev)
+}
+
+// categoryChanged counts a product attached to or detached from a category.
+func (j *job) categoryChanged(attached bool) {
+	j.update(func(st *jobstatus) {
+		if attached {
+			st.Categories.Attached++
+		} else {
+			st.Categories.Detached++
+		}
+	})
+}
+
+// jobsHandler serves GET /jobs?site=... with the jobs of a site,
+// GET /jobs/{id} with a single job, GET /jobs/{id}/events with its
+// progress as server-sent events and POST /jobs/{id}/cancel.
+func jobsHandler(rw http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/jobs"), "/")
+	if req.Method == "POST" && strings.HasSuffix(path, "/cancel") {
+		rw.Header().Set("Content-Type", "application/json")
+
+		var resp Response
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/cancel"))
+		j, ok := jobs.find(id)
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			resp = Response{Success: false, Message: "Job not found."}
+		} else if ok {
+			// The job runs on this instance.
+			if err = j.stopRun(); err != nil {
+				rw.WriteHeader(http.StatusConflict)
+				resp = Response{Success: false, Message: err.Error(), JobID: id}
+			} else {
+				resp = Response{Success: true, Message: "Cancelling.", JobID: id}
+			}
+		} else {
+			state, err := cancelJob(id)
+			if err == sql.ErrNoRows {
+				rw.WriteHeader(http.StatusNotFound)
+				resp = Response{Success: false, Message: "Job not found."}
+			} else if err != nil {
+				log.Println(err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				resp = Response{Success: false, Message: err.Error(), JobID: id}
+			} else if state == JOB_CANCELLED {
+				resp = Response{Success: true, Message: "Cancelled.", JobID: id}
+			} else if state == JOB_RUNNING {
+				resp = Response{Success: true, Message: "Cancelling.", JobID: id}
+			} else {
+				rw.WriteHeader(http.StatusConflict)
+				resp = Response{Success: false, Message: "Job is already " + state + ".", JobID: id}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+
+		var resp Response
+		if path == "" {
+			rows, err := selectJobs(req.FormValue("site"), maxJobs)
+			list := []jobstatus{}
+			for _, r := range rows {
+				if j, ok := jobs.find(r.ID); ok {
+					list = append(list, j.status())
+				} else {
+					list = append(list, r.status())
+				}
+			}
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(list)) + " jobs.",
+					Data:    list,
+				}
+			}
+		} else if strings.HasSuffix(path, "/events") {
+			jobEventsHandler(rw, req, strings.TrimSuffix(path, "/events"))
+			return
+		} else {
+			id, err := strconv.Atoi(path)
+			var st jobstatus
+			if err == nil {
+				st, err = jobStatus(id)
+			}
+			if err != nil {
+				if err != sql.ErrNoRows {
+					log.Println(err)
+				}
+				rw.WriteHeader(http.StatusNotFound)
+				resp = Response{Success: false, Message: "Job not found."}
+			} else {
+				resp = Response{Success: true, Message: "Job " + st.State + ".", Data: st, JobID: st.ID}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxJobEvents is the number of events a job keeps for listeners that
+// connect late or reconnect.
+const maxJobEvents = 1000
+
+// jobEventsKeepAlive is how often an idle event stream sends a comment so
+// that proxies keep it open.
+const jobEventsKeepAlive = 15 * time.Second
+
+// jobevent is a step of a job, sent to listeners as a server-sent event.
+type jobevent struct {
+	ID       int       `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	FeedID   int       `json:"feed_id,omitempty"`
+	Feed     string    `json:"feed,omitempty"`
+	Category string    `json:"category,omitempty"`
+	Done     int       `json:"done,omitempty"`
+	Total    int       `json:"total,omitempty"`
+	Bytes    int       `json:"bytes,omitempty"`
+	Rejected int       `json:"rejected,omitempty"`
+	State    string    `json:"state,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// jobevents is the event log of a job. Listeners wait on changed, which
+// is closed and replaced whenever an event is added.
+type jobevents struct {
+	mutex   sync.Mutex
+	lastID  int
+	list    []jobevent
+	changed chan struct{}
+	closed  bool
+}
+
+// emit adds an event to the log of the job and wakes its listeners.
+func (j *job) emit(ev jobevent) {
+	if j == nil {
+		return
+	}
+	e := &j.events
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.lastID++
+	ev.ID = e.lastID
+	ev.Time = time.Now()
+	e.list = append(e.list, ev)
+	if len(e.list) > maxJobEvents {
+		e.list = e.list[len(e.list)-maxJobEvents:]
+	}
+	if e.changed != nil {
+		close(e.changed)
+		e.changed = nil
+	}
+}
+
+// closeEvents marks the log complete once the job finished.
+func (j *job) closeEvents() {
+	e := &j.events
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.closed = true
+	if e.changed != nil {
+		close(e.changed)
+		e.changed = nil
+	}
+}
+
+// eventsAfter returns the events after id, whether the log is complete and
+// a channel that is closed when more events arrive.
+func (j *job) eventsAfter(id int) ([]jobevent, bool, chan struct{}) {
+	e := &j.events
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	events := []jobevent{}
+	for _, ev := range e.list {
+		if ev.ID > id {
+			events = append(events, ev)
+		}
+	}
+	if e.changed == nil {
+		e.changed = make(chan struct{})
+	}
+	return events, e.closed, e.changed
+}
+
+// jobEventsHandler streams the events of a job until it finishes or the
+// client goes away. Clients that reconnect with Last-Event-ID only get
+// the events they missed.
+func jobEventsHandler(rw http.ResponseWriter, req *http.Request, path string) {
+	id, err := strconv.Atoi(path)
+	j, ok := jobs.find(id)
+	if err == nil && !ok {
+		_, err = selectJob(id)
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(rw, Response{Success: false, Message: "Job not found."})
+		return
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(rw, Response{Success: false, Message: "Streaming is not supported."})
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(jobEventsKeepAlive)
+	defer keepAlive.Stop()
+
+	if !ok {
+		j = awaitJob(rw, req, id, keepAlive)
+		if j == nil {
+			return
+		}
+	}
+
+	last, _ := strconv.Atoi(req.Header.Get("Last-Event-ID"))
+
+	for {
+		events, closed, changed := j.eventsAfter(last)
+		for _, ev := range events {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+			last = ev.ID
+		}
+		flusher.Flush()
+
+		if closed {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// awaitJob waits for this instance to claim a queued job. When another
+// instance claims it, or it ends without running, its state is sent as a
+// job_state event and nil is returned: only the instance running a job
+// has its events.
+func awaitJob(rw http.ResponseWriter, req *http.Request, id int, keepAlive *time.Ticker) *job {
+	flusher := rw.(http.Flusher)
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-poll.C:
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+			continue
+		case <-req.Context().Done():
+			return nil
+		}
+
+		r, err := selectJob(id)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		if j, ok := jobs.find(id); ok {
+			return j
+		}
+		// A job this instance just claimed is registered right after.
+		if r.State != JOB_QUEUED && r.LeaseOwner != jobScheduler.instance {
+			data, _ := json.Marshal(jobevent{Type: "job_state", Time: time.Now(), State: r.State, Error: r.Error})
+			fmt.Fprintf(rw, "event: job_state\ndata: %s\n\n", data)
+			flusher.Flush()
+			return nil
+		}
+	}
+}
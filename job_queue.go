@@ -0,0 +1,486 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// jobLease is how long a claimed job stays with an instance without the
+// instance renewing its lease.
+const jobLease = 60 * time.Second
+
+// maxJobAttempts is how often a job is started before an interrupted run
+// fails it instead of queueing it again.
+const maxJobAttempts = 3
+
+// joboptions is what a queued job was asked to do, so that any instance
+// can rebuild its session.
+type joboptions struct {
+	Feeds            []int `json:"feeds,omitempty"`
+	ChangedOnly      bool  `json:"changed_only,omitempty"`
+	SkipCategories   bool  `json:"skip_categories,omitempty"`
+	OnlyCategoryID   int   `json:"only_category_id,omitempty"`
+	PreviousParentID int   `json:"previous_parent_id,omitempty"`
+}
+
+// jobrow is a job in the jobs table.
+type jobrow struct {
+	ID         int
+	SiteID     int
+	Site       string
+	Action     string
+	Priority   string
+	Options    joboptions
+	APIKey     string
+	State      string
+	Error      string
+	Result     string
+	Attempts   int
+	LeaseOwner string
+	QueuedAt   time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+const jobColumns = "j.id, j.site_id, s.subdomain, j.action, j.priority, j.options, " +
+	"j.api_key, j.state, j.error, j.result, j.attempts, j.lease_owner, " +
+	"UNIX_TIMESTAMP(j.queued_at), UNIX_TIMESTAMP(j.started_at), " +
+	"UNIX_TIMESTAMP(j.finished_at)"
+
+type jobscanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row jobscanner) (jobrow, error) {
+	r := jobrow{}
+	var options string
+	var apiKey, jobError, result, leaseOwner sql.NullString
+	var queuedAt int64
+	var startedAt, finishedAt sql.NullInt64
+	err := row.Scan(&r.ID, &r.SiteID, &r.Site, &r.Action, &r.Priority, &options,
+		&apiKey, &r.State, &jobError, &result, &r.Attempts, &leaseOwner, &queuedAt,
+		&startedAt, &finishedAt)
+	if err != nil {
+		return r, err
+	}
+	r.APIKey = apiKey.String
+	r.Error = jobError.String
+	r.Result = result.String
+	r.LeaseOwner = leaseOwner.String
+	r.QueuedAt = time.Unix(queuedAt, 0)
+	if startedAt.Valid {
+		t := time.Unix(startedAt.Int64, 0)
+		r.StartedAt = &t
+	}
+	if finishedAt.Valid {
+		t := time.Unix(finishedAt.Int64, 0)
+		r.FinishedAt = &t
+	}
+	return r, json.Unmarshal([]byte(options), &r.Options)
+}
+
+func selectJob(id int) (jobrow, error) {
+	return scanJob(authDB.QueryRow(
+		"SELECT "+jobColumns+" FROM jobs j JOIN sites s ON s.id = j.site_id WHERE j.id = ?", id))
+}
+
+// selectJobs lists the latest jobs of a site, newest first.
+func selectJobs(subdomain string, limit int) ([]jobrow, error) {
+	list := []jobrow{}
+	rows, err := authDB.Query(
+		"SELECT "+jobColumns+" FROM jobs j JOIN sites s ON s.id = j.site_id "+
+			"WHERE s.subdomain = ? ORDER BY j.id DESC LIMIT ?",
+		subdomain, limit)
+	if err != nil {
+		log.Println(err)
+		return list, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanJob(rows)
+		if err != nil {
+			log.Println(err)
+			return list, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// status returns the status a finished job saved, or what the table knows
+// of a job that did not finish yet.
+func (r jobrow) status() jobstatus {
+	st := jobstatus{}
+	if r.Result != "" && json.Unmarshal([]byte(r.Result), &st) == nil {
+		st.State = r.State
+		st.Attempts = r.Attempts
+		return st
+	}
+	st = jobstatus{
+		ID:         r.ID,
+		SiteID:     r.SiteID,
+		Site:       r.Site,
+		Action:     r.Action,
+		Priority:   r.Priority,
+		APIKey:     r.APIKey,
+		State:      r.State,
+		Error:      r.Error,
+		Attempts:   r.Attempts,
+		Stages:     []string{},
+		Feeds:      []feedresult{},
+		QueuedAt:   r.QueuedAt,
+		StartedAt:  r.StartedAt,
+		FinishedAt: r.FinishedAt,
+	}
+	if st.StartedAt != nil {
+		end := time.Now()
+		if st.FinishedAt != nil {
+			end = *st.FinishedAt
+		}
+		st.Duration = end.Sub(*st.StartedAt).Seconds()
+	}
+	return st
+}
+
+// jobStatus returns the live status of a job this instance runs, or else
+// the status from the jobs table.
+func jobStatus(id int) (jobstatus, error) {
+	if j, ok := jobs.find(id); ok {
+		return j.status(), nil
+	}
+	r, err := selectJob(id)
+	return r.status(), err
+}
+
+// jobOptions returns the options a job for action on s is queued with.
+func (s *session) jobOptions(action string) joboptions {
+	o := joboptions{}
+	switch action {
+	case "update":
+		for _, f := range s.feeds {
+			o.Feeds = append(o.Feeds, f.ID)
+		}
+		o.ChangedOnly = s.changedOnly
+		o.SkipCategories = s.skipCategories
+	case "refresh":
+		o.OnlyCategoryID = s.onlyCategoryID
+		o.PreviousParentID = s.previousParentID
+	}
+	return o
+}
+
+// session opens a session for the job as the handler that queued it did.
+// Feeds of an update that were removed since are left out.
+func (r jobrow) session() (session, error) {
+	var s session
+	err := s.init(r.Site)
+	if err != nil {
+		return s, err
+	}
+	if s.site.ID == 0 {
+		return s, errors.New("Site not found.")
+	}
+
+	if r.Action == "update" {
+		err = s.selectFeeds()
+		if err != nil {
+			return s, err
+		}
+		feeds := []*feed{}
+		for _, id := range r.Options.Feeds {
+			if f := s.findFeed(id); f != nil {
+				feeds = append(feeds, f)
+			}
+		}
+		s.feeds = feeds
+		if len(s.feeds) == 0 {
+			return s, errors.New("No feeds to parse.")
+		}
+	}
+	s.changedOnly = r.Options.ChangedOnly
+	s.skipCategories = r.Options.SkipCategories
+	s.onlyCategoryID = r.Options.OnlyCategoryID
+	s.previousParentID = r.Options.PreviousParentID
+	return s, nil
+}
+
+// lockSite locks the row of the site until tx ends, so that instances
+// queue and claim the jobs of a site one at a time.
+func lockSite(tx *sql.Tx, siteID int64) error {
+	var id int64
+	return tx.QueryRow("SELECT id FROM sites WHERE id = ? FOR UPDATE", siteID).Scan(&id)
+}
+
+// insertJob queues a job for action on the site of s. When the same work
+// is already queued, that job is returned instead, with the higher of
+// both priorities.
+func insertJob(s *session, action string, priority string) (int, error) {
+	options, err := json.Marshal(s.jobOptions(action))
+	if err != nil {
+		return 0, err
+	}
+	apiKey := sql.NullString{}
+	if s.apiRequest != nil {
+		apiKey = sql.NullString{String: s.apiRequest.key.Name, Valid: true}
+	}
+
+	tx, err := authDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = lockSite(tx, s.site.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	var queuedPriority string
+	err = tx.QueryRow(
+		"SELECT id, priority FROM jobs WHERE site_id = ? AND action = ? "+
+			"AND options = ? AND state = ? ORDER BY id LIMIT 1",
+		s.site.ID, action, string(options), JOB_QUEUED).Scan(&id, &queuedPriority)
+	if err == sql.ErrNoRows {
+		res, err := tx.Exec(
+			"INSERT INTO jobs (site_id, action, priority, options, api_key, state, "+
+				"queued_at, created_at, updated_at) VALUES (?,?,?,?,?,?,now(),now(),now())",
+			s.site.ID, action, priority, string(options), apiKey, JOB_QUEUED)
+		if err != nil {
+			return 0, err
+		}
+		lastID, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int(lastID)
+	} else if err != nil {
+		return 0, err
+	} else {
+		log.Printf("Merged %s request for %s into job %d", action, s.site.Name, id)
+		if priorityRank(priority) < priorityRank(queuedPriority) {
+			_, err = tx.Exec(
+				"UPDATE jobs SET priority = ?, updated_at = now() WHERE id = ?",
+				priority, id)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return id, tx.Commit()
+}
+
+// claimJob leases the next job that may run to owner: the oldest job of
+// the highest priority whose site has no running job.
+func claimJob(owner string) (jobrow, bool, error) {
+	tx, err := authDB.Begin()
+	if err != nil {
+		return jobrow{}, false, err
+	}
+	defer tx.Rollback()
+
+	// Sites with a running job are left out here, so that their queued jobs
+	// do not hide those of idle sites.
+	rows, err := tx.Query(
+		"SELECT id, site_id FROM jobs WHERE state = ? AND site_id NOT IN "+
+			"(SELECT site_id FROM jobs WHERE state = ?) ORDER BY priority = ?, id",
+		JOB_QUEUED, JOB_RUNNING, PRIORITY_SCHEDULED)
+	if err != nil {
+		return jobrow{}, false, err
+	}
+	type candidate struct {
+		id     int
+		siteID int64
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		c := candidate{}
+		err = rows.Scan(&c.id, &c.siteID)
+		if err != nil {
+			rows.Close()
+			return jobrow{}, false, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return jobrow{}, false, err
+	}
+
+	for _, c := range candidates {
+		err = lockSite(tx, c.siteID)
+		if err != nil {
+			return jobrow{}, false, err
+		}
+		// The candidates were read before the site was locked. A locking
+		// read sees the jobs other instances claimed for it since.
+		var running int
+		err = tx.QueryRow(
+			"SELECT COUNT(*) FROM jobs WHERE site_id = ? AND state = ? FOR UPDATE",
+			c.siteID, JOB_RUNNING).Scan(&running)
+		if err != nil {
+			return jobrow{}, false, err
+		}
+		if running > 0 {
+			continue
+		}
+
+		res, err := tx.Exec(
+			"UPDATE jobs SET state = ?, lease_owner = ?, "+
+				"lease_expires_at = now() + INTERVAL ? SECOND, attempts = attempts + 1, "+
+				"started_at = now(), updated_at = now() WHERE id = ? AND state = ?",
+			JOB_RUNNING, owner, int(jobLease.Seconds()), c.id, JOB_QUEUED)
+		if err != nil {
+			return jobrow{}, false, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		err = tx.Commit()
+		if err != nil {
+			return jobrow{}, false, err
+		}
+		r, err := selectJob(c.id)
+		return r, true, err
+	}
+	return jobrow{}, false, tx.Commit()
+}
+
+// renewLease keeps the job with owner. It reports whether the lease was
+// lost and whether cancelling the job was requested on another instance.
+func renewLease(id int, owner string) (bool, bool, error) {
+	res, err := authDB.Exec(
+		"UPDATE jobs SET lease_expires_at = now() + INTERVAL ? SECOND, updated_at = now() "+
+			"WHERE id = ? AND lease_owner = ? AND state = ?",
+		int(jobLease.Seconds()), id, owner, JOB_RUNNING)
+	if err != nil {
+		return false, false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return true, false, nil
+	}
+	var cancel bool
+	err = authDB.QueryRow("SELECT cancel_requested FROM jobs WHERE id = ?", id).Scan(&cancel)
+	return false, cancel, err
+}
+
+// saveJobResult records how the job ended, unless its lease was lost and
+// the job was queued again.
+func saveJobResult(j *job, owner string) error {
+	st := j.status()
+	result, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = authDB.Exec(
+		"UPDATE jobs SET state = ?, error = ?, result = ?, finished_at = now(), "+
+			"lease_owner = NULL, lease_expires_at = NULL, updated_at = now() "+
+			"WHERE id = ? AND lease_owner = ? AND state = ?",
+		st.State, sql.NullString{String: st.Error, Valid: st.Error != ""}, string(result),
+		j.ID, owner, JOB_RUNNING)
+	return err
+}
+
+// requeueJobs queues running jobs again whose lease expired, or that were
+// leased to owner by a process that is gone. Jobs that were started
+// maxJobAttempts times fail instead, and jobs that were asked to cancel are
+// cancelled.
+func requeueJobs(owner string) error {
+	res, err := authDB.Exec(
+		"UPDATE jobs SET state = ?, finished_at = now(), "+
+			"lease_owner = NULL, lease_expires_at = NULL, updated_at = now() "+
+			"WHERE state = ? AND cancel_requested = 1 "+
+			"AND (lease_expires_at < now() OR lease_owner = ?)",
+		JOB_CANCELLED, JOB_RUNNING, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Cancelled %d interrupted jobs", n)
+	}
+
+	res, err = authDB.Exec(
+		"UPDATE jobs SET state = IF(attempts >= ?, ?, ?), "+
+			"error = IF(attempts >= ?, ?, error), finished_at = IF(attempts >= ?, now(), NULL), "+
+			"lease_owner = NULL, lease_expires_at = NULL, updated_at = now() "+
+			"WHERE state = ? AND cancel_requested = 0 "+
+			"AND (lease_expires_at < now() OR lease_owner = ?)",
+		maxJobAttempts, JOB_FAILED, JOB_QUEUED,
+		maxJobAttempts, "Interrupted too often.", maxJobAttempts,
+		JOB_RUNNING, owner)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Queued %d interrupted jobs again", n)
+	}
+	return nil
+}
+
+// cancelJob cancels a queued job, or asks the instance running it to stop.
+// It returns the state of the job afterwards.
+func cancelJob(id int) (string, error) {
+	res, err := authDB.Exec(
+		"UPDATE jobs SET state = ?, finished_at = now(), updated_at = now() "+
+			"WHERE id = ? AND state = ?",
+		JOB_CANCELLED, id, JOB_QUEUED)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return JOB_CANCELLED, nil
+	}
+
+	res, err = authDB.Exec(
+		"UPDATE jobs SET cancel_requested = 1, updated_at = now() WHERE id = ? AND state = ?",
+		id, JOB_RUNNING)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return JOB_RUNNING, nil
+	}
+
+	r, err := selectJob(id)
+	return r.State, err
+}
+
+// queueDepth counts the queued and the running jobs of all instances.
+func queueDepth() (int, int, error) {
+	var queued, running int
+	err := authDB.QueryRow(
+		"SELECT COALESCE(SUM(state = ?), 0), COALESCE(SUM(state = ?), 0) FROM jobs "+
+			"WHERE state IN (?,?)",
+		JOB_QUEUED, JOB_RUNNING, JOB_QUEUED, JOB_RUNNING).Scan(&queued, &running)
+	return queued, running, err
+}
+
+// lastSuccesses returns when each site last had a successful run, or only
+// the site with the given subdomain unless it is empty.
+func lastSuccesses(subdomain string) (map[string]time.Time, error) {
+	last := make(map[string]time.Time)
+	rows, err := authDB.Query(
+		"SELECT s.subdomain, UNIX_TIMESTAMP(MAX(j.finished_at)) FROM jobs j "+
+			"JOIN sites s ON s.id = j.site_id WHERE j.state = ? "+
+			"AND (? = '' OR s.subdomain = ?) GROUP BY s.subdomain",
+		JOB_SUCCEEDED, subdomain, subdomain)
+	if err != nil {
+		return last, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var site string
+		var finishedAt int64
+		err = rows.Scan(&site, &finishedAt)
+		if err != nil {
+			return last, err
+		}
+		last[site] = time.Unix(finishedAt, 0)
+	}
+	return last, rows.Err()
+}
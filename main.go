@@ -1,12 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var addr = flag.String("addr", ":8001", "http service address")
@@ -15,16 +20,27 @@ var dbPassword = flag.String("dbPassword", "password", "database password")
 var dbAddr = flag.String("dbAddr", "localhost", "database address")
 var dbPort = flag.Int("dbPort", 3306, "database port")
 var database = flag.String("database", "database", "database name")
-var SessionQueue = make(chan int, 1)
+var requireAuth = flag.Bool("auth", true, "require an API key on every request")
+var createKey = flag.String("createKey", "", "create an API key with this name, print it and exit")
+var keySites = flag.String("keySites", "", "comma separated subdomains the new API key may use, * for all")
+var keyPermissions = flag.String("keyPermissions", "read", "comma separated permissions of the new API key")
+var maxConcurrentJobs = flag.Int("jobs", 2, "number of jobs this instance runs at the same time, at most one per site")
+var instance = flag.String("instance", "", "name of this instance in the job queue, host name and address by default")
 
 type sessionmessage struct {
-  session  *session
+	session *session
+}
+
+// dataSourceName returns the MySQL DSN built from the flags.
+func dataSourceName() string {
+	return fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", *dbUser, *dbPassword, *dbAddr, *dbPort, *database)
 }
 
 func getSession(req *http.Request) (session, Response) {
 	var s session
 	var resp Response
 	site := req.FormValue("site")
+	s.apiRequest = apiRequestFrom(req)
 	err := s.init(site)
 	if err != nil {
 		resp = Response{Success: false, Message: err.Error()}
@@ -43,17 +59,51 @@ func getSession(req *http.Request) (session, Response) {
 	return s, resp
 }
 
+// getSiteSession opens a session for the requested site without selecting
+// its feeds, for handlers that only read.
+func getSiteSession(req *http.Request) (session, Response) {
+	var s session
+	s.apiRequest = apiRequestFrom(req)
+	err := s.init(req.FormValue("site"))
+	if err != nil {
+		return s, Response{Success: false, Message: err.Error()}
+	}
+	if s.site.ID == 0 {
+		return s, Response{Success: false, Message: "Site not found."}
+	}
+	return s, Response{Success: true}
+}
+
+// queueAction queues a job for the action and adds its id to resp. The
+// job is an already queued one when the same work was requested before.
+func queueAction(s session, action string, priority string, resp Response) Response {
+	id, err := jobScheduler.enqueue(s, action, priority)
+	if err != nil {
+		log.Println(err)
+		return Response{Success: false, Message: "Could not queue the job."}
+	}
+	resp.JobID = id
+	return resp
+}
+
+// runAction runs a job the scheduler claimed.
 func runAction(s session, action string) {
-	SessionQueue <- 1
+	runningJobs.WithLabelValues(action).Inc()
+	defer runningJobs.WithLabelValues(action).Dec()
+
 	log.Println("Starting action " + action)
+	s.job.start()
 	s.prepare()
 	if action == "refresh" {
 		s.refresh()
 	} else if action == "update" {
 		s.update()
+	} else if action == "suggest" {
+		s.suggest()
 	} else {
-		<-SessionQueue
-  }
+		s.db.Close()
+	}
+	s.job.finish()
 }
 
 // handler handles incoming requests for feed updates.
@@ -63,26 +113,153 @@ func updateFeedsHandler(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Content-Type", "application/json")
 
 		s, resp := getSession(req)
-
-		fmt.Fprint(rw, resp)
-
 		if len(s.feeds) > 0 {
-			go runAction(s, "update")
+			resp = queueAction(s, "update", requestPriority(req), resp)
 		}
 
+		fmt.Fprint(rw, resp)
+
 	} else {
 		http.NotFound(rw, req)
 	}
 }
 
+// refreshHandler compares every category with every product of the site
+// again, which picks up products edited outside a feed run.
 func refreshHandler(rw http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
 		rw.Header().Set("Content-Type", "application/json")
 		s, resp := getSession(req)
+		if resp.Success {
+			resp = queueAction(s, "refresh", requestPriority(req), resp)
+		} else {
+			s.db.Close()
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// feedHandler serves POST /feeds/{id}/update, which fetches and syncs a
+// single feed of the site. Only the products of the feed are re-evaluated
+// by the category sync, and categories=0 skips the category sync.
+func feedHandler(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/feeds/"), "/"), "/")
+	if req.Method == "POST" && len(parts) == 2 && parts[1] == "update" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSession(req)
+
+		feedID, _ := strconv.Atoi(parts[0])
+		f := s.findFeed(feedID)
+		if resp.Success && f == nil {
+			resp = Response{Success: false, Message: "Feed not found."}
+		}
+
+		if resp.Success {
+			s.feeds = []*feed{f}
+			s.changedOnly = true
+			s.skipCategories = req.FormValue("categories") == "0"
+			resp = queueAction(s, "update", requestPriority(req), resp)
+		} else {
+			s.db.Close()
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// rejectionsHandler lists the products a feed rejected in its last run
+// together with the reasons.
+func rejectionsHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			feedID, _ := strconv.Atoi(req.FormValue("feed"))
+			f := s.findFeed(feedID)
+			if f == nil {
+				resp = Response{Success: false, Message: "Feed not found."}
+			} else {
+				rejections, err := f.selectRejections(&s)
+				if err != nil {
+					resp = Response{Success: false, Message: err.Error()}
+				} else {
+					resp = Response{
+						Success: true,
+						Message: strconv.Itoa(len(rejections)) + " rejected products.",
+						Data:    rejections,
+					}
+				}
+			}
+		}
 
 		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
 
-		go runAction(s, "refresh")
+// offersHandler returns a canonical product with the offers of every
+// merchant selling it.
+func offersHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			id, _ := strconv.Atoi(req.FormValue("canonical_product"))
+			c, err := s.selectCanonicalProduct(id)
+			if err == sql.ErrNoRows {
+				resp = Response{Success: false, Message: "Canonical product not found."}
+			} else if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(c.Offers)) + " offers.",
+					Data:    c,
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// resolveSlugHandler returns the current slug of a product or category for
+// a slug that may have been renamed, so frontends can redirect old URLs.
+func resolveSlugHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			entityType := req.FormValue("type")
+			if entityType != "product" && entityType != "category" {
+				resp = Response{Success: false, Message: "Invalid type."}
+			} else {
+				slug, err := resolveSlug(&s, entityType, req.FormValue("slug"))
+				if err == sql.ErrNoRows {
+					resp = Response{Success: false, Message: "Slug not found."}
+				} else if err != nil {
+					resp = Response{Success: false, Message: err.Error()}
+				} else {
+					resp = Response{Success: true, Message: slug, Data: Map{"slug": slug}}
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
 	} else {
 		http.NotFound(rw, req)
 	}
@@ -92,8 +269,61 @@ func main() {
 	flag.Parse()
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
-	http.HandleFunc("/updatefeeds", updateFeedsHandler)
-	http.HandleFunc("/refresh", refreshHandler)
+	var err error
+	authDB, err = sql.Open("mysql", dataSourceName())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *createKey != "" {
+		key, err := createAPIKey(*createKey, strings.Split(*keySites, ","), strings.Split(*keyPermissions, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	name := *instance
+	if name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		name = host + *addr
+	}
+	jobScheduler.start(name)
+
+	http.HandleFunc("/updatefeeds", authorize(PERMISSION_RUN, PERMISSION_RUN, updateFeedsHandler))
+	http.HandleFunc("/refresh", authorize(PERMISSION_RUN, PERMISSION_RUN, refreshHandler))
+	http.HandleFunc("/jobs", authorize(PERMISSION_JOBS, PERMISSION_RUN, jobsHandler))
+	http.HandleFunc("/jobs/", authorize(PERMISSION_JOBS, PERMISSION_RUN, jobsHandler))
+	http.HandleFunc("/feeds/rejections", authorize(PERMISSION_READ, PERMISSION_READ, rejectionsHandler))
+	http.HandleFunc("/feeds/", authorize(PERMISSION_RUN, PERMISSION_RUN, feedHandler))
+	http.HandleFunc("/products", authorize(PERMISSION_READ, PERMISSION_READ, productsHandler))
+	http.HandleFunc("/products/", authorize(PERMISSION_READ, PERMISSION_READ, productsHandler))
+	http.HandleFunc("/categories", authorize(PERMISSION_READ, PERMISSION_READ, categoriesHandler))
+	http.HandleFunc("/offers", authorize(PERMISSION_READ, PERMISSION_READ, offersHandler))
+	http.HandleFunc("/slugs/resolve", authorize(PERMISSION_READ, PERMISSION_READ, resolveSlugHandler))
+	http.HandleFunc("/categories/tree", authorize(PERMISSION_READ, PERMISSION_READ, categoryTreeHandler))
+	http.HandleFunc("/categories/preview", authorize(PERMISSION_READ, PERMISSION_READ, categoryPreviewHandler))
+	http.HandleFunc("/categories/create", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, createCategoryHandler))
+	http.HandleFunc("/categories/update", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, updateCategoryHandler))
+	http.HandleFunc("/categories/delete", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, deleteCategoryHandler))
+	http.HandleFunc("/categories/unmapped", authorize(PERMISSION_READ, PERMISSION_READ, unmappedCategoriesHandler))
+	http.HandleFunc("/categories/mappings", authorize(PERMISSION_READ, PERMISSION_CATEGORIES, categoryMappingsHandler))
+	http.HandleFunc("/categories/mappings/delete", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, deleteCategoryMappingHandler))
+	http.HandleFunc("/categories/products/include", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, includeProductHandler))
+	http.HandleFunc("/categories/products/exclude", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, excludeProductHandler))
+	http.HandleFunc("/categories/products/reset", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, resetProductHandler))
+	http.HandleFunc("/categories/suggestions", authorize(PERMISSION_READ, PERMISSION_READ, suggestionsHandler))
+	http.HandleFunc("/categories/suggestions/generate", authorize(PERMISSION_RUN, PERMISSION_RUN, generateSuggestionsHandler))
+	http.HandleFunc("/categories/suggestions/accept", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, acceptSuggestionHandler))
+	http.HandleFunc("/categories/suggestions/reject", authorize(PERMISSION_CATEGORIES, PERMISSION_CATEGORIES, rejectSuggestionHandler))
+	http.HandleFunc("/metrics", authorize(PERMISSION_JOBS, PERMISSION_JOBS, promhttp.Handler().ServeHTTP))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	http.HandleFunc("/readyz/sites", authorize(PERMISSION_JOBS, PERMISSION_JOBS, lastSuccessHandler))
 
 	message := fmt.Sprintf("Starting server on %v", *addr)
 	log.Println(message)
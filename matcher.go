@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// searchquery is a parsed category search string. It keeps the MySQL
+// boolean mode syntax categories are written in: plain words are optional,
+// +word is required, -word excludes, "a phrase" matches words in order,
+// word* matches by prefix and parentheses group clauses. The relevance
+// operators > < and ~ are accepted and ignored.
+type searchquery struct {
+	Clauses []searchclause
+}
+
+type searchclause struct {
+	Operator rune
+	Term     *searchterm
+	Group    *searchquery
+}
+
+// searchterm is a word or a phrase. Words are stored both as typed and
+// stemmed.
+type searchterm struct {
+	Text   string
+	Words  []string
+	Stems  []string
+	Prefix bool
+}
+
+// searchdocument is the tokenised text of a product.
+type searchdocument struct {
+	Words []string
+	Stems []string
+}
+
+// swedishSuffixes and englishSuffixes are stripped by stem, longest first.
+var swedishSuffixes = []string{
+	"heterna", "hetens", "heten", "arnas", "ernas", "ornas", "andet",
+	"arna", "erna", "orna", "ande", "ende", "aste", "het", "are", "ast",
+	"ens", "ers", "ars", "en", "ar", "er", "or", "et", "na",
+}
+
+var englishSuffixes = []string{
+	"ingly", "ings", "ing", "edly", "ies", "es", "ed", "ly", "s",
+}
+
+// minStemLength keeps short words such as "tv" and "usb" intact.
+const minStemLength = 3
+
+// tokenise splits str into lower case words of letters and digits.
+func tokenise(str string) []string {
+	return strings.FieldsFunc(strings.ToLower(str), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// stem reduces a lower case word to a crude common stem so that
+// "löparskor" and "löparskorna" or "shoe" and "shoes" compare equal. The
+// same stemmer runs on queries and products, so consistency matters more
+// than linguistic accuracy.
+func stem(word string) string {
+	runes := []rune(word)
+	if len(runes) <= minStemLength {
+		return word
+	}
+
+	for _, suffixes := range [][]string{swedishSuffixes, englishSuffixes} {
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(word, suffix) &&
+				len([]rune(word))-len([]rune(suffix)) >= minStemLength {
+				word = strings.TrimSuffix(word, suffix)
+				break
+			}
+		}
+	}
+
+	// Trailing vowels vary between inflections, "skjorta" and "skjortor".
+	runes = []rune(word)
+	if len(runes) > minStemLength && strings.ContainsRune("aeo", runes[len(runes)-1]) {
+		word = string(runes[:len(runes)-1])
+	}
+	return word
+}
+
+func stems(words []string) []string {
+	s := make([]string, len(words))
+	for i, w := range words {
+		s[i] = stem(w)
+	}
+	return s
+}
+
+func newSearchDocument(texts ...string) searchdocument {
+	words := []string{}
+	for _, t := range texts {
+		words = append(words, tokenise(t)...)
+	}
+	return searchdocument{Words: words, Stems: stems(words)}
+}
+
+// parseSearchQuery parses a category search string. It never fails;
+// unbalanced quotes and parentheses are closed at the end of the string.
+func parseSearchQuery(str string) searchquery {
+	q, _ := parseSearchClauses([]rune(str), 0)
+	return q
+}
+
+func parseSearchClauses(runes []rune, i int) (searchquery, int) {
+	q := searchquery{}
+	for i < len(runes) {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r), r == '>', r == '<', r == '~':
+			i++
+			continue
+		case r == ')':
+			return q, i + 1
+		}
+
+		clause := searchclause{}
+		if r == '+' || r == '-' {
+			clause.Operator = r
+			i++
+			if i >= len(runes) {
+				break
+			}
+			r = runes[i]
+		}
+
+		switch {
+		case r == '(':
+			var group searchquery
+			group, i = parseSearchClauses(runes, i+1)
+			clause.Group = &group
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			clause.Term = newSearchTerm(string(runes[i+1 : end]))
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) &&
+				!strings.ContainsRune("()\"", runes[end]) {
+				end++
+			}
+			if end == i {
+				i++
+				continue
+			}
+			clause.Term = newSearchTerm(string(runes[i:end]))
+			i = end
+		}
+
+		if clause.Group != nil || (clause.Term != nil && len(clause.Term.Words) > 0) {
+			q.Clauses = append(q.Clauses, clause)
+		}
+	}
+	return q, i
+}
+
+func newSearchTerm(text string) *searchterm {
+	t := &searchterm{Text: text}
+	if strings.HasSuffix(text, "*") {
+		t.Prefix = true
+	}
+	t.Words = tokenise(text)
+	t.Stems = stems(t.Words)
+	return t
+}
+
+// match reports whether the term occurs in the document. Phrases need
+// their words in order; a prefix term matches the start of the last word.
+func (t searchterm) match(doc searchdocument) bool {
+	n := len(t.Words)
+	for i := 0; i+n <= len(doc.Words); i++ {
+		found := true
+		for j := 0; j < n; j++ {
+			if t.Prefix && j == n-1 {
+				found = strings.HasPrefix(doc.Words[i+j], t.Words[j])
+			} else {
+				found = doc.Stems[i+j] == t.Stems[j]
+			}
+			if !found {
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// match evaluates the query the way MySQL boolean mode filters rows: every
+// required clause must match, no excluded clause may match, and without
+// required clauses at least one optional clause must match. It also
+// returns the terms that matched.
+func (q searchquery) match(doc searchdocument) (bool, []string) {
+	matched := []string{}
+	required := false
+	optional := false
+
+	for _, c := range q.Clauses {
+		var hit bool
+		var terms []string
+		if c.Group != nil {
+			hit, terms = c.Group.match(doc)
+		} else {
+			hit = c.Term.match(doc)
+			if hit {
+				terms = []string{c.Term.Text}
+			}
+		}
+
+		switch c.Operator {
+		case '-':
+			if hit {
+				return false, nil
+			}
+		case '+':
+			if !hit {
+				return false, nil
+			}
+			required = true
+			matched = append(matched, terms...)
+		default:
+			if hit {
+				optional = true
+				matched = append(matched, terms...)
+			}
+		}
+	}
+
+	return required || optional, matched
+}
+
+// searchDocument returns the cached search document of a product.
+func (s *session) searchDocument(p product) searchdocument {
+	if s.searchDocuments == nil {
+		s.searchDocuments = make(map[int]searchdocument)
+	}
+	doc, ok := s.searchDocuments[p.ID]
+	if !ok {
+		description := p.DescriptionText
+		if description == "" {
+			description = plainText(p.Description)
+		}
+		doc = newSearchDocument(p.Name, p.NameByUser, description)
+		s.searchDocuments[p.ID] = doc
+	}
+	return doc
+}
+
+// selectSiteProducts loads every product of the site for category matching.
+// The products are cached for the rest of the session.
+func (s *session) selectSiteProducts() ([]product, error) {
+	if s.siteProducts != nil {
+		return s.siteProducts, nil
+	}
+
+	products := []product{}
+	rows, err := s.selectSiteProductsStmt.Query(s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return products, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanSiteProduct(rows)
+		if err != nil {
+			log.Println(err)
+			return products, err
+		}
+		products = append(products, p)
+	}
+
+	err = rows.Err()
+	if err == nil {
+		s.siteProducts = products
+	}
+	return products, err
+}
+
+// siteProductColumns are the product columns scanSiteProduct reads.
+const siteProductColumns = "id, site_id, feed_id, brand_id, name_by_user, name, slug, " +
+	"identifier, price, regular_price, description_by_user, description, " +
+	"description_text, currency, url, graphic_url, shipping_price, " +
+	"in_stock, points, has_categories, active, brand, merchant_category, " +
+	"created_at, updated_at, deleted_at"
+
+// scanSiteProduct reads a row selected with siteProductColumns.
+func scanSiteProduct(rows *sql.Rows) (product, error) {
+	p := product{}
+	err := rows.Scan(
+		&p.ID,
+		&p.SiteID,
+		&p.FeedID,
+		&p.BrandID,
+		&p.NameByUser,
+		&p.Name,
+		&p.Slug,
+		&p.Identifier,
+		&p.Price,
+		&p.RegularPrice,
+		&p.DescriptionByUser,
+		&p.Description,
+		&p.DescriptionText,
+		&p.Currency,
+		&p.ProductURL,
+		&p.GraphicURL,
+		&p.ShippingPrice,
+		&p.InStock,
+		&p.Points,
+		&p.HasCategories,
+		&p.Active,
+		&p.Brand,
+		&p.MerchantCategory,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+		&p.DeletedAt,
+	)
+	return p, err
+}
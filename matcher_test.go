@@ -0,0 +1,153 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenise(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"Samsung 55\" TV", []string{"samsung", "55", "tv"}},
+		{"USB-C kabel, 2m", []string{"usb", "c", "kabel", "2m"}},
+		{"Löparskor för DAM", []string{"löparskor", "för", "dam"}},
+		{"  ", []string{}},
+	}
+	for _, tt := range tests {
+		got := tokenise(tt.in)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenise(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStem(t *testing.T) {
+	// Short words are kept as they are.
+	for _, w := range []string{"tv", "usb", "hdd", "4k"} {
+		if got := stem(w); got != w {
+			t.Errorf("stem(%q) = %q, want it unchanged", w, got)
+		}
+	}
+
+	// Inflections of a word share a stem.
+	same := []struct{ a, b string }{
+		{"shoe", "shoes"},
+		{"jumping", "jumps"},
+		{"box", "boxes"},
+		{"löparskor", "löparskorna"},
+		{"skjorta", "skjortor"},
+		{"jacka", "jackor"},
+		{"byxa", "byxor"},
+	}
+	for _, tt := range same {
+		if stem(tt.a) != stem(tt.b) {
+			t.Errorf("stem(%q) = %q, stem(%q) = %q, want them equal",
+				tt.a, stem(tt.a), tt.b, stem(tt.b))
+		}
+	}
+
+	// Different words keep different stems.
+	different := []struct{ a, b string }{
+		{"tv", "tvätt"},
+		{"skor", "skjorta"},
+	}
+	for _, tt := range different {
+		if stem(tt.a) == stem(tt.b) {
+			t.Errorf("stem(%q) and stem(%q) are both %q", tt.a, tt.b, stem(tt.a))
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	q := parseSearchQuery(`+tv -begagnad "smart tv" lapt* >extra (a b)`)
+	want := []struct {
+		operator rune
+		text     string
+		prefix   bool
+		group    bool
+	}{
+		{'+', "tv", false, false},
+		{'-', "begagnad", false, false},
+		{0, "smart tv", false, false},
+		{0, "lapt*", true, false},
+		{0, "extra", false, false},
+		{0, "", false, true},
+	}
+	if len(q.Clauses) != len(want) {
+		t.Fatalf("got %d clauses, want %d", len(q.Clauses), len(want))
+	}
+	for i, w := range want {
+		c := q.Clauses[i]
+		if c.Operator != w.operator {
+			t.Errorf("clause %d: operator %q, want %q", i, c.Operator, w.operator)
+		}
+		if w.group {
+			if c.Group == nil || len(c.Group.Clauses) != 2 {
+				t.Errorf("clause %d: want a group of two clauses", i)
+			}
+			continue
+		}
+		if c.Term == nil || c.Term.Text != w.text || c.Term.Prefix != w.prefix {
+			t.Errorf("clause %d: term %+v, want %q prefix %v", i, c.Term, w.text, w.prefix)
+		}
+	}
+
+	// Unbalanced quotes and parentheses are closed at the end.
+	if q := parseSearchQuery(`"running shoes`); len(q.Clauses) != 1 || q.Clauses[0].Term.Text != "running shoes" {
+		t.Errorf("unclosed phrase parsed as %+v", q)
+	}
+	if q := parseSearchQuery(`+(tv monitor`); len(q.Clauses) != 1 || q.Clauses[0].Group == nil {
+		t.Errorf("unclosed group parsed as %+v", q)
+	}
+}
+
+func TestSearchQueryMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		text  string
+		want  bool
+	}{
+		{"short word", "tv", "Samsung 55\" TV", true},
+		{"short word is not a prefix", "tv", "Tvättmedel 2 kg", false},
+		{"short word in compound token", "usb", "USB-C kabel", true},
+		{"phrase in order", `"running shoes"`, "Nike running shoes", true},
+		{"phrase out of order", `"running shoes"`, "Shoes for running", false},
+		{"phrase stemmed", `"running shoe"`, "Running shoes, men", true},
+		{"prefix", "lapt*", "Lenovo Laptop 14", true},
+		{"prefix needs the whole prefix", "lapt*", "Lap desk", false},
+		{"prefix in phrase", `"gaming lapt*"`, "Asus gaming laptop", true},
+		{"required", "+shoes", "Running shoes", true},
+		{"required missing", "+shoes sandals", "Summer sandals", false},
+		{"excluded", "+shoes -kids", "Kids shoes", false},
+		{"not excluded", "+shoes -kids", "Trail shoes", true},
+		{"optional", "jacka kappa", "Kappa i ull", true},
+		{"no optional matches", "jacka kappa", "Byxor", false},
+		{"group", "+(tv monitor) -begagnad", "LG monitor 27", true},
+		{"group excluded", "+(tv monitor) -begagnad", "Begagnad TV", false},
+		{"swedish plural", "jacka", "Jackor för vinter", true},
+		{"swedish definite", "löparskor", "Löparskorna från Asics", true},
+		{"english plural", "shoe", "Shoes", true},
+		{"empty query", "", "Anything", false},
+		{"relevance operators ignored", ">tv <radio ~dvd", "Radio", true},
+	}
+	for _, tt := range tests {
+		got, _ := parseSearchQuery(tt.query).match(newSearchDocument(tt.text))
+		if got != tt.want {
+			t.Errorf("%s: %q matching %q = %v, want %v", tt.name, tt.query, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchQueryMatchTerms(t *testing.T) {
+	_, terms := parseSearchQuery(`+shoes "trail run*" -kids road`).match(newSearchDocument("Trail running shoes"))
+	want := []string{"shoes", "trail run*"}
+	if !reflect.DeepEqual(terms, want) {
+		t.Errorf("matched terms %q, want %q", terms, want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics served on /metrics. Feed metrics are labelled with the feed id
+// rather than its name, which editors can change.
+var (
+	feedFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "affilparser_feed_fetch_duration_seconds",
+		Help:    "Time spent downloading a feed.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"feed"})
+
+	feedFetchBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "affilparser_feed_fetch_bytes",
+		Help:    "Size of a downloaded feed.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"feed"})
+
+	feedParseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "affilparser_feed_parse_duration_seconds",
+		Help:    "Time spent parsing and normalising a feed.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"feed"})
+
+	feedParsedProducts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "affilparser_feed_parsed_products",
+		Help: "Products in the feed at its last parse.",
+	}, []string{"feed"})
+
+	productWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "affilparser_product_writes_total",
+		Help: "Products written by the session workers, by feed, action and result.",
+	}, []string{"feed", "action", "result"})
+
+	productWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "affilparser_product_write_duration_seconds",
+		Help:    "Time a session worker spent writing a product.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"action"})
+
+	categoryChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "affilparser_category_changes_total",
+		Help: "Products attached to or detached from categories by the category sync.",
+	}, []string{"change"})
+
+	queueWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "affilparser_queue_wait_seconds",
+		Help:    "Time a job waited for the scheduler to start it.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 14),
+	}, []string{"action"})
+
+	runningJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "affilparser_running_jobs",
+		Help: "Jobs currently running.",
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		feedFetchDuration,
+		feedFetchBytes,
+		feedParseDuration,
+		feedParsedProducts,
+		productWrites,
+		productWriteDuration,
+		categoryChanges,
+		queueWaitDuration,
+		runningJobs,
+	)
+}
+
+// dbActionName names a DBACTION for metric labels.
+func dbActionName(action int) string {
+	switch action {
+	case DBACTION_INSERT:
+		return "insert"
+	case DBACTION_UPDATE:
+		return "update"
+	case DBACTION_DELETE:
+		return "delete"
+	}
+	return "none"
+}
+
+// label returns the feed id as a metric label.
+func (f *feed) label() string {
+	return strconv.Itoa(f.ID)
+}
+
+// observeProductWrite records a product written by a session worker.
+func observeProductWrite(f *feed, action int, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	productWriteDuration.WithLabelValues(dbActionName(action)).Observe(time.Since(start).Seconds())
+	productWrites.WithLabelValues(f.label(), dbActionName(action), result).Inc()
+}
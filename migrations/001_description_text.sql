@@ -0,0 +1,12 @@
+-- Plain text copy of the sanitised description, and a per site switch to
+-- store descriptions as plain text instead of allow-listed HTML.
+ALTER TABLE products
+    ADD COLUMN description_text TEXT NULL AFTER description;
+
+UPDATE products SET description_text = '';
+
+ALTER TABLE products
+    MODIFY COLUMN description_text TEXT NOT NULL;
+
+ALTER TABLE sites
+    ADD COLUMN plain_text_descriptions TINYINT(1) NOT NULL DEFAULT 0;
@@ -0,0 +1,32 @@
+-- Product validation rules per site, optionally overridden per feed, and
+-- the products each feed had rejected in its last run.
+CREATE TABLE validation_rules (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    feed_id INT UNSIGNED NULL,
+    require_image TINYINT(1) NOT NULL DEFAULT 1,
+    min_description_length INT NOT NULL DEFAULT 1,
+    require_price TINYINT(1) NOT NULL DEFAULT 0,
+    currencies VARCHAR(255) NULL,
+    require_valid_url TINYINT(1) NOT NULL DEFAULT 0,
+    min_name_length INT NOT NULL DEFAULT 0,
+    max_name_length INT NOT NULL DEFAULT 0,
+    invalid_action ENUM('skip', 'deactivate') NOT NULL DEFAULT 'deactivate',
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY validation_rules_site_feed_unique (site_id, feed_id)
+);
+
+CREATE TABLE product_rejections (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    feed_id INT UNSIGNED NOT NULL,
+    product_id INT UNSIGNED NULL,
+    identifier VARCHAR(255) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    reason VARCHAR(1024) NOT NULL,
+    created_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    KEY product_rejections_feed_id_index (feed_id)
+);
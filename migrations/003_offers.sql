@@ -0,0 +1,26 @@
+-- Offers: feed products are grouped under canonical products matched by
+-- normalised EAN/GTIN-14, falling back to brand and MPN.
+ALTER TABLE products
+    ADD COLUMN ean VARCHAR(14) NOT NULL DEFAULT '' AFTER identifier,
+    ADD COLUMN mpn VARCHAR(255) NOT NULL DEFAULT '' AFTER ean,
+    ADD COLUMN brand VARCHAR(255) NOT NULL DEFAULT '' AFTER mpn,
+    ADD COLUMN canonical_product_id INT UNSIGNED NULL,
+    ADD KEY products_canonical_product_id_index (canonical_product_id);
+
+CREATE TABLE canonical_products (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    match_key VARCHAR(255) NOT NULL,
+    ean VARCHAR(14) NOT NULL DEFAULT '',
+    brand VARCHAR(255) NOT NULL DEFAULT '',
+    mpn VARCHAR(255) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    offer_count INT UNSIGNED NOT NULL DEFAULT 0,
+    min_price DECIMAL(10, 2) NULL,
+    currency VARCHAR(3) NOT NULL DEFAULT '',
+    cheapest_product_id INT UNSIGNED NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY canonical_products_site_match_key_unique (site_id, match_key)
+);
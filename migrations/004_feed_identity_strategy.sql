@@ -0,0 +1,5 @@
+-- How products of a feed are identified between runs: sku, ean, url or
+-- composite (SKU and EAN together).
+ALTER TABLE feeds
+    ADD COLUMN identity_strategy ENUM('sku', 'ean', 'url', 'composite')
+        NOT NULL DEFAULT 'sku';
@@ -0,0 +1,11 @@
+-- Old slugs of renamed products and categories, for redirects.
+CREATE TABLE slug_history (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    entity_type ENUM('product', 'category') NOT NULL,
+    entity_id INT UNSIGNED NOT NULL,
+    slug VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY slug_history_site_type_slug_unique (site_id, entity_type, slug)
+);
@@ -0,0 +1,7 @@
+-- Structured category rules (JSON) and the merchant category of products
+-- they can filter on.
+ALTER TABLE categories
+    ADD COLUMN rules TEXT NULL AFTER search;
+
+ALTER TABLE products
+    ADD COLUMN merchant_category VARCHAR(1024) NOT NULL DEFAULT '' AFTER brand;
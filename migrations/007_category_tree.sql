@@ -0,0 +1,5 @@
+-- Full slug paths of categories, and whether a category includes the
+-- products of its subcategories.
+ALTER TABLE categories
+    ADD COLUMN path VARCHAR(1024) NULL AFTER slug,
+    ADD COLUMN include_subcategories TINYINT(1) NOT NULL DEFAULT 0;
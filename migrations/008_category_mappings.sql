@@ -0,0 +1,14 @@
+-- Mappings from merchant categories, optionally limited to a feed or a
+-- network, to site categories.
+CREATE TABLE category_mappings (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    feed_id INT UNSIGNED NULL,
+    network_id INT UNSIGNED NULL,
+    merchant_category VARCHAR(1024) NOT NULL,
+    category_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    KEY category_mappings_site_id_index (site_id)
+);
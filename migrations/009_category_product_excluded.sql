@@ -0,0 +1,5 @@
+-- Products editors keep out of a category. Excluded rows are not part of
+-- the category and do not count towards products.has_categories, so
+-- readers of category_product must filter on excluded = 0.
+ALTER TABLE category_product
+    ADD COLUMN excluded TINYINT(1) NOT NULL DEFAULT 0 AFTER forced;
@@ -0,0 +1,6 @@
+-- Hash of the search, rules, mappings and included subcategories a
+-- category was last fully synced with. Categories whose hash still matches
+-- only re-evaluate the products a feed update changed. NULL forces a full
+-- sync.
+ALTER TABLE categories
+    ADD COLUMN synced_hash CHAR(40) NULL AFTER include_subcategories;
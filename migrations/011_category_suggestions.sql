@@ -0,0 +1,16 @@
+-- Categories the classifier suggests for products without categories.
+-- Accepted and rejected rows are kept so the same suggestion is not made
+-- again; pending rows are replaced on every run.
+CREATE TABLE category_suggestions (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    product_id INT UNSIGNED NOT NULL,
+    category_id INT UNSIGNED NOT NULL,
+    confidence DOUBLE NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY category_suggestions_product_category_unique (product_id, category_id),
+    KEY category_suggestions_site_status_index (site_id, status)
+);
@@ -0,0 +1,16 @@
+-- Figures for category landing pages, stored after every category sync,
+-- and the category description with its {{placeholders}} filled in.
+CREATE TABLE category_stats (
+    category_id INT UNSIGNED NOT NULL,
+    product_count INT UNSIGNED NOT NULL DEFAULT 0,
+    min_price DECIMAL(10,2) NOT NULL DEFAULT 0,
+    max_price DECIMAL(10,2) NOT NULL DEFAULT 0,
+    on_sale_count INT UNSIGNED NOT NULL DEFAULT 0,
+    brands TEXT NOT NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (category_id)
+);
+
+ALTER TABLE categories
+    ADD COLUMN rendered_description TEXT NULL AFTER description;
@@ -0,0 +1,35 @@
+-- API keys are stored as SHA-256 hashes. A key either covers all sites or
+-- the sites listed in api_key_sites. Permissions are a comma separated
+-- list of read, run, jobs and categories.
+CREATE TABLE api_keys (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    name VARCHAR(255) NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    all_sites TINYINT(1) NOT NULL DEFAULT 0,
+    permissions VARCHAR(255) NOT NULL DEFAULT '',
+    revoked_at TIMESTAMP NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY api_keys_key_hash_unique (key_hash)
+);
+
+CREATE TABLE api_key_sites (
+    api_key_id INT UNSIGNED NOT NULL,
+    site_id INT UNSIGNED NOT NULL,
+    PRIMARY KEY (api_key_id, site_id)
+);
+
+-- Every request that is not a GET, with the job it started if any.
+CREATE TABLE api_audit_log (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    api_key_id INT UNSIGNED NOT NULL,
+    site VARCHAR(255) NOT NULL,
+    method VARCHAR(8) NOT NULL,
+    path VARCHAR(255) NOT NULL,
+    job_id INT UNSIGNED NULL,
+    created_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    KEY api_audit_log_api_key_id_index (api_key_id),
+    KEY api_audit_log_job_id_index (job_id)
+);
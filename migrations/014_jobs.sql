@@ -0,0 +1,28 @@
+-- The job queue shared by all instances. An instance claims a queued job
+-- by setting lease_owner and keeps lease_expires_at in the future while it
+-- runs the job. Running jobs whose lease expired are queued again.
+-- options holds what the job was asked to do, as JSON, and result the
+-- final job status reported by GET /jobs/{id}.
+CREATE TABLE jobs (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    site_id INT UNSIGNED NOT NULL,
+    action VARCHAR(32) NOT NULL,
+    priority VARCHAR(16) NOT NULL,
+    options TEXT NOT NULL,
+    api_key VARCHAR(255) NULL,
+    state VARCHAR(16) NOT NULL,
+    error TEXT NULL,
+    result MEDIUMTEXT NULL,
+    attempts INT UNSIGNED NOT NULL DEFAULT 0,
+    cancel_requested TINYINT(1) NOT NULL DEFAULT 0,
+    lease_owner VARCHAR(255) NULL,
+    lease_expires_at TIMESTAMP NULL,
+    queued_at TIMESTAMP NULL,
+    started_at TIMESTAMP NULL,
+    finished_at TIMESTAMP NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    KEY jobs_state_priority_index (state, priority, id),
+    KEY jobs_site_id_state_index (site_id, state)
+);
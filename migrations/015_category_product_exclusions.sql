@@ -0,0 +1,21 @@
+-- Products editors keep out of a category get their own table, so that
+-- category_product only ever holds the products that belong to a category.
+-- This replaces category_product.excluded from 009.
+CREATE TABLE category_product_exclusions (
+    id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+    category_id INT UNSIGNED NOT NULL,
+    product_id INT UNSIGNED NOT NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY category_product_exclusions_unique (category_id, product_id),
+    KEY category_product_exclusions_product_id_index (product_id)
+);
+
+INSERT INTO category_product_exclusions (category_id, product_id, created_at, updated_at)
+    SELECT category_id, product_id, created_at, now() FROM category_product
+    WHERE excluded = 1;
+
+DELETE FROM category_product WHERE excluded = 1;
+
+ALTER TABLE category_product DROP COLUMN excluded;
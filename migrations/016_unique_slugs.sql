@@ -0,0 +1,16 @@
+-- Slugs are unique per site, also when several instances pick slugs at the
+-- same time. Duplicates from before get the id appended; all but the
+-- oldest entity with a slug are renamed.
+UPDATE products p
+    INNER JOIN products o ON o.site_id = p.site_id AND o.slug = p.slug AND o.id < p.id
+    SET p.slug = CONCAT(p.slug, '-', p.id);
+
+UPDATE categories c
+    INNER JOIN categories o ON o.site_id = c.site_id AND o.slug = c.slug AND o.id < c.id
+    SET c.slug = CONCAT(c.slug, '-', c.id);
+
+ALTER TABLE products
+    ADD UNIQUE KEY products_site_slug_unique (site_id, slug);
+
+ALTER TABLE categories
+    ADD UNIQUE KEY categories_site_slug_unique (site_id, slug);
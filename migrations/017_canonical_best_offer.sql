@@ -0,0 +1,5 @@
+-- min_price and cheapest_product_id are the lowest priced offer, in stock
+-- or not. best_product_id is the offer to link to: the cheapest one in
+-- stock, or the cheapest one if none is.
+ALTER TABLE canonical_products
+    ADD COLUMN best_product_id INT UNSIGNED NULL AFTER cheapest_product_id;
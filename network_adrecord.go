@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"log"
 	"strconv"
-	"strings"
 )
 
 type adrecord struct {
@@ -43,9 +42,11 @@ func (n adrecord) parseProducts(f *feed) ([]product, error) {
 	for _, v := range a.Products {
 		var errs error
 		p := product{}
-		p.Name = strings.Replace(v.Name, "&quot;", "", -1)
-		p.Slug = generateSlug(p.Name)
+		p.Name = v.Name
 		p.Identifier = v.SKU
+		p.EAN = v.EAN
+		p.MPN = v.Model
+		p.Brand = v.Brand
 		p.Price, errs = strconv.ParseFloat(v.Price, 64)
 		if errs != nil {
 			p.Price = 0
@@ -4,13 +4,14 @@ import (
 	"encoding/xml"
 	"log"
 	"strconv"
-	"strings"
 )
 
 type AdtractionProduct struct {
 	SKU         string
 	Name        string
 	Description string
+	Brand       string
+	Ean         string
 	Category    string
 	Price       string
 	Shipping    string
@@ -39,9 +40,11 @@ func (n adtraction) parseProducts(f *feed) ([]product, error) {
 	for _, v := range a.Products {
 		var errs error
 		p := product{}
-		p.Name = strings.Replace(v.Name, "&quot;", "", -1)
-		p.Slug = generateSlug(p.Name)
+		p.Name = v.Name
 		p.Identifier = v.SKU
+		p.EAN = v.Ean
+		p.Brand = v.Brand
+		p.MerchantCategory = v.Category
 		p.Price, errs = strconv.ParseFloat(v.Price, 64)
 		if errs != nil {
 			p.Price = 0
@@ -4,6 +4,9 @@ const NETWORK_ADRECORD = 1
 const NETWORK_TRADEDOUBLER = 2
 const NETWORK_ADTRACTION = 3
 
+// MERCHANT_CATEGORY_SEPARATOR joins the levels of a merchant category path.
+const MERCHANT_CATEGORY_SEPARATOR = " > "
+
 type networkinterface interface {
 	parseProducts(f *feed) ([]product, error)
 }
@@ -70,9 +70,20 @@ func (n tradedoubler) parseProducts(f *feed) ([]product, error) {
 	for _, v := range a.Products {
 		var errs error
 		p := product{}
-		p.Name = strings.Replace(v.Name, "&quot;", "", -1)
-		p.Slug = generateSlug(p.Name)
+		p.Name = v.Name
 		p.Identifier = v.Identifiers.SKU
+		p.EAN = v.Identifiers.EAN
+		p.MPN = v.Identifiers.MPN
+		p.Brand = v.Brand
+		path := []string{}
+		for _, c := range v.Categories {
+			if c.Name != "" {
+				path = append(path, c.Name)
+			} else if c.TDCategoryName != "" {
+				path = append(path, c.TDCategoryName)
+			}
+		}
+		p.MerchantCategory = strings.Join(path, MERCHANT_CATEGORY_SEPARATOR)
 		p.Price, errs = strconv.ParseFloat(v.Offers[0].PriceHistory[0].Price.Value, 64)
 		if errs != nil {
 			p.Price = 0
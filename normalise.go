@@ -0,0 +1,95 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// maxEntityPasses bounds how many times entities are decoded. Some feeds
+// double encode their markup (&amp;lt;br&amp;gt;).
+const maxEntityPasses = 3
+
+var descriptionPolicy = newDescriptionPolicy()
+var stripPolicy = bluemonday.StrictPolicy()
+
+var lineBreakPattern = regexp.MustCompile(`(?i)<\s*br\s*/?\s*>|<\s*/\s*(p|div|li|h[1-6]|tr)\s*>`)
+var spacePattern = regexp.MustCompile(`[ \t\f\v\p{Zs}]+`)
+var blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+
+// newDescriptionPolicy returns the allow-list used for descriptions stored
+// as HTML. Attributes, inline styles and scripts are all dropped.
+func newDescriptionPolicy() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements(
+		"p", "br", "b", "strong", "i", "em", "u",
+		"ul", "ol", "li", "h3", "h4", "h5", "h6",
+	)
+	return p
+}
+
+// decodeEntities fully decodes HTML entities, including double encoded ones.
+func decodeEntities(str string) string {
+	for i := 0; i < maxEntityPasses; i++ {
+		decoded := html.UnescapeString(str)
+		if decoded == str {
+			break
+		}
+		str = decoded
+	}
+	return str
+}
+
+// normaliseText turns a feed value into a single line of plain text.
+func normaliseText(str string) string {
+	str = lineBreakPattern.ReplaceAllString(decodeEntities(str), " ")
+	str = html.UnescapeString(stripPolicy.Sanitize(str))
+	return strings.Join(strings.Fields(str), " ")
+}
+
+// plainText converts a description to plain text, keeping line breaks
+// where the markup had block elements.
+func plainText(str string) string {
+	str = lineBreakPattern.ReplaceAllString(decodeEntities(str), "\n")
+	str = html.UnescapeString(stripPolicy.Sanitize(str))
+	str = strings.Replace(str, "\r\n", "\n", -1)
+
+	lines := strings.Split(str, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(spacePattern.ReplaceAllString(line, " "))
+	}
+	str = strings.Join(lines, "\n")
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(str, "\n\n"))
+}
+
+// sanitiseDescription decodes a description and reduces its markup to the
+// description allow-list.
+func sanitiseDescription(str string) string {
+	str = descriptionPolicy.Sanitize(decodeEntities(str))
+	return strings.TrimSpace(spacePattern.ReplaceAllString(str, " "))
+}
+
+// normalise cleans up the values a network parser produced. Names are
+// reduced to plain text and descriptions are sanitised, or converted to
+// plain text if the site asks for it.
+func (p *product) normalise(si *site) {
+	p.Name = normaliseText(p.Name)
+	p.Slug = generateSlug(p.Name)
+	p.Brand = normaliseText(p.Brand)
+	p.MerchantCategory = normaliseText(p.MerchantCategory)
+	p.MPN = normaliseText(p.MPN)
+	p.EAN = normaliseGTIN(p.EAN)
+	p.DescriptionText = plainText(p.Description)
+
+	if si != nil && si.PlainTextDescriptions {
+		p.Description = p.DescriptionText
+	} else {
+		p.Description = sanitiseDescription(p.Description)
+	}
+
+	if p.DescriptionText == "" {
+		p.Description = ""
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// offer is a feed product seen as one merchant's offer of a canonical
+// product.
+type offer struct {
+	ProductID          int     `json:"product_id"`
+	FeedID             int     `json:"feed_id"`
+	Merchant           string  `json:"merchant"`
+	Name               string  `json:"name"`
+	EAN                string  `json:"-"`
+	Brand              string  `json:"-"`
+	MPN                string  `json:"-"`
+	Price              float64 `json:"price"`
+	ShippingPrice      float64 `json:"shipping_price"`
+	Currency           string  `json:"currency"`
+	ProductURL         string  `json:"url"`
+	InStock            bool    `json:"in_stock"`
+	CanonicalProductID int     `json:"-"`
+}
+
+// canonicalproduct groups the offers of the same product across feeds.
+type canonicalproduct struct {
+	ID                int     `json:"id"`
+	SiteID            int     `json:"site_id"`
+	MatchKey          string  `json:"match_key"`
+	EAN               string  `json:"ean"`
+	Brand             string  `json:"brand"`
+	MPN               string  `json:"mpn"`
+	Name              string  `json:"name"`
+	OfferCount        int     `json:"offer_count"`
+	MinPrice          float64 `json:"min_price"`
+	Currency          string  `json:"currency"`
+	CheapestProductID int     `json:"cheapest_product_id"`
+	BestProductID     int     `json:"best_product_id"`
+	Offers            []offer `json:"offers"`
+}
+
+// normaliseGTIN returns the EAN/UPC/GTIN as a zero padded GTIN-14, or an
+// empty string if it is not a valid GTIN.
+func normaliseGTIN(str string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		if unicode.IsSpace(r) || r == '-' {
+			return -1
+		}
+		return 'x'
+	}, str)
+
+	switch len(digits) {
+	case 8, 12, 13, 14:
+	default:
+		return ""
+	}
+	if strings.ContainsRune(digits, 'x') || strings.Trim(digits, "0") == "" {
+		return ""
+	}
+
+	digits = strings.Repeat("0", 14-len(digits)) + digits
+	sum := 0
+	for i, r := range digits[:13] {
+		d := int(r - '0')
+		if i%2 == 0 {
+			d *= 3
+		}
+		sum += d
+	}
+	if (10-sum%10)%10 != int(digits[13]-'0') {
+		return ""
+	}
+	return digits
+}
+
+// normaliseMPN strips everything but letters and digits from a
+// manufacturer part number or brand, so formatting differences between
+// merchants do not matter.
+func normaliseMPN(str string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, str)
+}
+
+// matchKey returns the key offers of the same product share. EAN wins,
+// brand and MPN together are the fallback. Offers without either are not
+// matched.
+func (o offer) matchKey() string {
+	if o.EAN != "" {
+		return "ean:" + o.EAN
+	}
+	brand := normaliseMPN(o.Brand)
+	mpn := normaliseMPN(o.MPN)
+	if brand != "" && mpn != "" {
+		return "mpn:" + brand + ":" + mpn
+	}
+	return ""
+}
+
+// cheapest returns the offer with the lowest total price, in stock or not.
+func cheapest(offers []offer) offer {
+	var lowest offer
+	for i, o := range offers {
+		if i == 0 || o.Price+o.ShippingPrice < lowest.Price+lowest.ShippingPrice {
+			lowest = o
+		}
+	}
+	return lowest
+}
+
+// bestOffer returns the best available offer: the cheapest one in stock, or
+// the cheapest one if none is in stock.
+func bestOffer(offers []offer) offer {
+	var best offer
+	found := false
+	for _, o := range offers {
+		if !found ||
+			(o.InStock && !best.InStock) ||
+			(o.InStock == best.InStock && o.Price+o.ShippingPrice < best.Price+best.ShippingPrice) {
+			best = o
+			found = true
+		}
+	}
+	return best
+}
+
+// selectOffers loads every live product of the site as an offer.
+func (s *session) selectOffers() ([]offer, error) {
+	offers := []offer{}
+	rows, err := s.selectSiteOffersStmt.Query(s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return offers, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var canonicalID sql.NullInt64
+		o := offer{}
+		err := rows.Scan(
+			&o.ProductID,
+			&o.FeedID,
+			&o.Merchant,
+			&o.Name,
+			&o.EAN,
+			&o.Brand,
+			&o.MPN,
+			&o.Price,
+			&o.ShippingPrice,
+			&o.Currency,
+			&o.ProductURL,
+			&o.InStock,
+			&canonicalID,
+		)
+		if err != nil {
+			log.Println(err)
+			return offers, err
+		}
+		o.CanonicalProductID = int(canonicalID.Int64)
+		offers = append(offers, o)
+	}
+
+	err = rows.Err()
+	return offers, err
+}
+
+// matchOffers groups the products of the site under canonical products and
+// refreshes the cheapest and best offer and offer count of each.
+func (s *session) matchOffers() error {
+	offers, err := s.selectOffers()
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string][]offer)
+	for _, o := range offers {
+		key := o.matchKey()
+		if key == "" {
+			if o.CanonicalProductID > 0 {
+				s.setCanonicalProduct(o.ProductID, 0)
+			}
+			continue
+		}
+		groups[key] = append(groups[key], o)
+	}
+
+	stale, err := s.selectCanonicalProductIDs()
+	if err != nil {
+		return err
+	}
+
+	for key, group := range groups {
+		lowest := cheapest(group)
+		best := bestOffer(group)
+		res, err := s.db.Exec(
+			"INSERT INTO canonical_products (site_id, match_key, ean, brand, "+
+				"mpn, name, offer_count, min_price, currency, cheapest_product_id, "+
+				"best_product_id, created_at, updated_at) "+
+				"VALUES (?,?,?,?,?,?,?,?,?,?,?,now(),now()) "+
+				"ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id), "+
+				"offer_count = VALUES(offer_count), min_price = VALUES(min_price), "+
+				"currency = VALUES(currency), "+
+				"cheapest_product_id = VALUES(cheapest_product_id), "+
+				"best_product_id = VALUES(best_product_id), updated_at = now()",
+			s.site.ID,
+			key,
+			best.EAN,
+			best.Brand,
+			best.MPN,
+			best.Name,
+			len(group),
+			lowest.Price,
+			lowest.Currency,
+			lowest.ProductID,
+			best.ProductID,
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		delete(stale, int(id))
+
+		for _, o := range group {
+			if o.CanonicalProductID != int(id) {
+				s.setCanonicalProduct(o.ProductID, int(id))
+			}
+		}
+	}
+
+	// Canonical products are kept for stable URLs even when no merchant
+	// offers them any more.
+	for id := range stale {
+		_, err = s.db.Exec(
+			"UPDATE canonical_products SET offer_count = 0, min_price = NULL, "+
+				"cheapest_product_id = NULL, best_product_id = NULL, "+
+				"updated_at = now() WHERE id = ?", id)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	log.Println("Matched " + s.site.Name + " offers into canonical products")
+	return nil
+}
+
+func (s *session) setCanonicalProduct(productID int, canonicalID int) {
+	_, err := s.db.Exec(
+		"UPDATE products SET canonical_product_id = ? WHERE id = ?",
+		sql.NullInt64{Int64: int64(canonicalID), Valid: canonicalID > 0},
+		productID,
+	)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// selectCanonicalProductIDs returns the ids of the canonical products of the
+// site that still have offers.
+func (s *session) selectCanonicalProductIDs() (map[int]bool, error) {
+	ids := make(map[int]bool)
+	rows, err := s.db.Query(
+		"SELECT id FROM canonical_products WHERE site_id = ? AND offer_count > 0",
+		s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return ids, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			log.Println(err)
+			return ids, err
+		}
+		ids[id] = true
+	}
+
+	err = rows.Err()
+	return ids, err
+}
+
+// selectCanonicalProduct loads a canonical product of the site with its
+// current offers, best first: offers in stock before the others, cheapest
+// first within each.
+func (s *session) selectCanonicalProduct(id int) (canonicalproduct, error) {
+	var c canonicalproduct
+	var minPrice sql.NullFloat64
+	var cheapestID, bestID sql.NullInt64
+	err := s.db.QueryRow(
+		"SELECT id, site_id, match_key, ean, brand, mpn, name, offer_count, "+
+			"min_price, currency, cheapest_product_id, best_product_id "+
+			"FROM canonical_products WHERE id = ? AND site_id = ?",
+		id, s.site.ID).Scan(
+		&c.ID,
+		&c.SiteID,
+		&c.MatchKey,
+		&c.EAN,
+		&c.Brand,
+		&c.MPN,
+		&c.Name,
+		&c.OfferCount,
+		&minPrice,
+		&c.Currency,
+		&cheapestID,
+		&bestID,
+	)
+	if err != nil {
+		log.Println(err)
+		return c, err
+	}
+	c.MinPrice = minPrice.Float64
+	c.CheapestProductID = int(cheapestID.Int64)
+	c.BestProductID = int(bestID.Int64)
+	c.Offers = []offer{}
+
+	rows, err := s.selectCanonicalOffersStmt.Query(c.ID)
+	if err != nil {
+		log.Println(err)
+		return c, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var canonicalID sql.NullInt64
+		o := offer{}
+		err := rows.Scan(
+			&o.ProductID,
+			&o.FeedID,
+			&o.Merchant,
+			&o.Name,
+			&o.EAN,
+			&o.Brand,
+			&o.MPN,
+			&o.Price,
+			&o.ShippingPrice,
+			&o.Currency,
+			&o.ProductURL,
+			&o.InStock,
+			&canonicalID,
+		)
+		if err != nil {
+			log.Println(err)
+			return c, err
+		}
+		c.Offers = append(c.Offers, o)
+	}
+
+	err = rows.Err()
+	return c, err
+}
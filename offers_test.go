@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNormaliseGTIN(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"EAN-8", "96385074", "00000096385074"},
+		{"UPC-12", "036000291452", "00036000291452"},
+		{"EAN-13", "4006381333931", "04006381333931"},
+		{"GTIN-14", "10012345678902", "10012345678902"},
+		{"dashes", "400-6381-33393-1", "04006381333931"},
+		{"spaces", " 4006381 333931 ", "04006381333931"},
+		{"bad check digit", "4006381333932", ""},
+		{"bad check digit EAN-8", "96385075", ""},
+		{"all zeros", "0000000000000", ""},
+		{"letters", "40063813339X1", ""},
+		{"too short", "1234567", ""},
+		{"eleven digits", "03600029145", ""},
+		{"too long", "400638133393100", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := normaliseGTIN(tt.in); got != tt.want {
+			t.Errorf("%s: normaliseGTIN(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
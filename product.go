@@ -3,8 +3,6 @@ package main
 import (
 	"database/sql"
 	"log"
-	"strings"
-	"unicode"
 )
 
 type product struct {
@@ -15,11 +13,16 @@ type product struct {
 	Name              string
 	NameByUser        string
 	Slug              string
+	PreviousSlug      string
 	Identifier        string
+	EAN               string
+	MPN               string
 	Categories        []categoryinterface
 	Description       string
+	DescriptionText   string
 	DescriptionByUser string
 	Brand             string
+	MerchantCategory  string
 	Price             float64
 	ProductURL        string
 	GraphicURL        string
@@ -59,50 +62,124 @@ func (p product) isDeleted() bool {
 	return p.DeletedAt.String != ""
 }
 
-func (p product) insert(s *session) error {
-	_, err := s.db.Exec(
-		"INSERT INTO products (name, site_id, slug, feed_id, identifier, description, "+
-			"price, regular_price, currency, shipping_price, "+
-			"in_stock, url, graphic_url, created_at, updated_at) "+
-			"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,now(),now())",
-		p.Name,
-		p.SiteID,
-		p.Slug,
-		p.FeedID,
-		p.Identifier,
-		p.Description,
-		p.Price,
-		p.RegularPrice,
-		p.Currency,
-		p.ShippingPrice,
-		p.InStock,
-		p.ProductURL,
-		p.GraphicURL,
-	)
+// insert saves p as a new product with a unique slug. A slug that another
+// instance took in the meantime is replaced by the next free one.
+func (p *product) insert(s *session) error {
+	var res sql.Result
+	slugMutex.Lock()
+	defer slugMutex.Unlock()
+
+	slug := p.Slug
+	for attempt := 1; ; attempt++ {
+		var err error
+		p.Slug, err = uniqueSlug(s, p.getEntityType(), p.SiteID, slug, 0)
+		if err != nil {
+			return err
+		}
+
+		res, err = s.db.Exec(
+			"INSERT INTO products (name, site_id, slug, feed_id, identifier, description, "+
+				"description_text, price, regular_price, currency, shipping_price, "+
+				"in_stock, url, graphic_url, ean, mpn, brand, merchant_category, "+
+				"created_at, updated_at) "+
+				"VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,now(),now())",
+			p.Name,
+			p.SiteID,
+			p.Slug,
+			p.FeedID,
+			p.Identifier,
+			p.Description,
+			p.DescriptionText,
+			p.Price,
+			p.RegularPrice,
+			p.Currency,
+			p.ShippingPrice,
+			p.InStock,
+			p.ProductURL,
+			p.GraphicURL,
+			p.EAN,
+			p.MPN,
+			p.Brand,
+			p.MerchantCategory,
+		)
+		if isDuplicateSlug(err) && attempt < slugAttempts {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	id, err := res.LastInsertId()
+	p.ID = int(id)
 	return err
 }
 
+// update saves p. A changed slug is made unique, like on insert, and the
+// previous slug is kept in the slug history.
 func (p product) update(s *session) error {
-	_, err := s.db.Exec(
-		"UPDATE products SET name = ?, identifier = ?, description = ?, "+
-			"price = ?, regular_price = ?, currency = ?, shipping_price = ?,"+
-			"in_stock = ?, url = ?, graphic_url = ?, has_categories = ?, "+
-			"updated_at = now(), deleted_at = ? WHERE id = ?",
-		p.Name,
-		p.Identifier,
-		p.Description,
-		p.Price,
-		p.RegularPrice,
-		p.Currency,
-		p.ShippingPrice,
-		p.InStock,
-		p.ProductURL,
-		p.GraphicURL,
-		p.HasCategories,
-		p.DeletedAt,
-		p.ID,
-	)
-	return err
+	if p.PreviousSlug != "" {
+		slugMutex.Lock()
+		defer slugMutex.Unlock()
+	}
+
+	slug := p.Slug
+	for attempt := 1; ; attempt++ {
+		err := p.updateSlug(s, slug)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.db.Exec(
+			"UPDATE products SET name = ?, slug = ?, identifier = ?, description = ?, "+
+				"description_text = ?, price = ?, regular_price = ?, currency = ?, shipping_price = ?,"+
+				"in_stock = ?, url = ?, graphic_url = ?, has_categories = ?, "+
+				"ean = ?, mpn = ?, brand = ?, merchant_category = ?, "+
+				"updated_at = now(), deleted_at = ? WHERE id = ?",
+			p.Name,
+			p.Slug,
+			p.Identifier,
+			p.Description,
+			p.DescriptionText,
+			p.Price,
+			p.RegularPrice,
+			p.Currency,
+			p.ShippingPrice,
+			p.InStock,
+			p.ProductURL,
+			p.GraphicURL,
+			p.HasCategories,
+			p.EAN,
+			p.MPN,
+			p.Brand,
+			p.MerchantCategory,
+			p.DeletedAt,
+			p.ID,
+		)
+		if isDuplicateSlug(err) && attempt < slugAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// updateSlug picks a unique slug from slug if the slug of p changes, and
+// keeps the previous slug in the slug history.
+func (p *product) updateSlug(s *session, slug string) error {
+	if p.PreviousSlug == "" {
+		return nil
+	}
+
+	var err error
+	p.Slug, err = uniqueSlug(s, p.getEntityType(), p.SiteID, slug, p.ID)
+	if err != nil {
+		return err
+	}
+	if p.Slug == p.PreviousSlug {
+		return nil
+	}
+	return saveSlugHistory(s, p.getEntityType(), p.SiteID, p.ID, p.PreviousSlug)
 }
 
 func (p *product) updateHasCategories(s *session) error {
@@ -111,15 +188,20 @@ func (p *product) updateHasCategories(s *session) error {
 
 	if err != nil {
 		log.Println(err)
+		return err
 	}
 
 	if count == 0 && p.HasCategories == true {
 		p.HasCategories = false
-		p.update(s)
 	} else if count > 0 && p.HasCategories == false {
 		p.HasCategories = true
-		p.update(s)
+	} else {
+		return err
 	}
+
+	// Only touch has_categories, p may have been loaded without every column.
+	_, err = s.db.Exec("UPDATE products SET has_categories = ? WHERE id = ?",
+		p.HasCategories, p.ID)
 	return err
 }
 
@@ -147,31 +229,18 @@ func (p *product) selectCategories(s *session) ([]categoryinterface, error) {
 		cp := categoryproduct{}
 		err := rows.Scan(
 			&cp.ID,
-			&cp.product.SiteID,
-			&cp.product.FeedID,
-			&cp.product.Name,
-			&cp.product.NameByUser,
-			&cp.product.Identifier,
-			&cp.product.Price,
-			&cp.product.RegularPrice,
-			&cp.product.Description,
-			&cp.product.DescriptionByUser,
-			&cp.product.Currency,
-			&cp.product.ProductURL,
-			&cp.product.GraphicURL,
-			&cp.product.ShippingPrice,
-			&cp.product.InStock,
-			&cp.product.Points,
-			&cp.product.HasCategories,
-			&cp.product.Active,
+			&cp.category.Name,
+			&cp.category.Search,
+			&cp.category.Description,
 			&cp.CategoryID,
-			&cp.product.ID,
 			&cp.Forced,
 		)
 		if err != nil {
 			log.Println(err)
 			return categoryproducts, err
 		} else {
+			cp.category.ID = cp.CategoryID
+			cp.ProductID = p.ID
 			categoryproducts = append(categoryproducts, &cp)
 		}
 	}
@@ -218,6 +287,7 @@ func (p *product) selectCategoryProduct(s *session, c *category) (categoryproduc
 		if err != nil {
 			log.Println(err)
 		}
+		cp.ProductID = cp.product.ID
 	}
 
 	err = rows.Err()
@@ -232,12 +302,15 @@ func (p *product) attachCategory(s *session, c categoryinterface) error {
 		c.getCategoryID(),
 		p.ID,
 	)
-
-	err = p.updateHasCategories(s)
+	if err == nil {
+		err = p.updateHasCategories(s)
+	}
 
 	if err != nil {
 		log.Println("Could not attach category "+c.getName()+" to: "+p.Name, err)
 	} else {
+		s.job.categoryChanged(true)
+		categoryChanges.WithLabelValues("attach").Inc()
 		log.Println("Attached category " + c.getName() + " to: " + p.Name)
 	}
 	return err
@@ -247,40 +320,20 @@ func (p *product) detachCategory(s *session, cp categoryproduct) error {
 	_, err := s.db.Exec(
 		"DELETE FROM category_product "+
 			"WHERE id = ?", cp.ID)
-
-	err = p.updateHasCategories(s)
+	if err == nil {
+		err = p.updateHasCategories(s)
+	}
 
 	if err != nil {
 		log.Println("Could not detach category "+cp.category.Name+" from: "+p.Name, err)
 	} else {
+		s.job.categoryChanged(false)
+		categoryChanges.WithLabelValues("detach").Inc()
 		log.Println("Detached category " + cp.category.Name + " from: " + p.Name)
 	}
 	return err
 }
 
-func (p *product) validate(f *feed) bool {
-	if f.AllowEmptyDescription == false {
-		if p.Description == "" {
-			return false
-		}
-	}
-	return true
-}
-
-func generateSlug(str string) (slug string) {
-	return strings.Map(func(r rune) rune {
-		switch {
-		case r == ' ', r == '-':
-			return '-'
-		case r == '_', unicode.IsLetter(r), unicode.IsDigit(r):
-			return r
-		default:
-			return -1
-		}
-		return -1
-	}, strings.ToLower(strings.TrimSpace(str)))
-}
-
 func (p *product) indexesOf(slice []categoryproduct) []int {
 	indexes := []int{}
 	for i, ele := range slice {
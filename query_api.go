@@ -0,0 +1,482 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultPageSize and maxPageSize bound the products of one page.
+const defaultPageSize = 50
+const maxPageSize = 500
+
+// productSortColumns are the columns products can be sorted by. Names sort
+// like the API returns them, with the name editors gave a product first.
+var productSortColumns = map[string]string{
+	"id":         "id",
+	"name":       "COALESCE(NULLIF(name_by_user, ''), name)",
+	"price":      "price",
+	"updated_at": "updated_at",
+}
+
+// productresource is a product as the query API returns it. Frontends
+// depend on these fields rather than on the products table.
+type productresource struct {
+	ID               int               `json:"id"`
+	SiteID           int               `json:"site_id"`
+	FeedID           int               `json:"feed_id"`
+	Name             string            `json:"name"`
+	FeedName         string            `json:"feed_name"`
+	Slug             string            `json:"slug"`
+	Identifier       string            `json:"identifier"`
+	Brand            string            `json:"brand"`
+	MerchantCategory string            `json:"merchant_category"`
+	Description      string            `json:"description"`
+	Price            float64           `json:"price"`
+	RegularPrice     float64           `json:"regular_price"`
+	ShippingPrice    float64           `json:"shipping_price"`
+	Currency         string            `json:"currency"`
+	URL              string            `json:"url"`
+	GraphicURL       string            `json:"graphic_url"`
+	InStock          bool              `json:"in_stock"`
+	HasCategories    bool              `json:"has_categories"`
+	Active           bool              `json:"active"`
+	CreatedAt        string            `json:"created_at"`
+	UpdatedAt        string            `json:"updated_at"`
+	DeletedAt        *string           `json:"deleted_at"`
+	Categories       []productcategory `json:"categories,omitempty"`
+}
+
+// productcategory is a category a product belongs to.
+type productcategory struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Forced bool   `json:"forced"`
+}
+
+// productpage is a page of products. NextCursor is empty on the last page.
+type productpage struct {
+	Products   []productresource `json:"products"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// categoryresource is a category with its stored stats.
+type categoryresource struct {
+	ID                   int            `json:"id"`
+	ParentID             int            `json:"parent_id,omitempty"`
+	Name                 string         `json:"name"`
+	Slug                 string         `json:"slug"`
+	Path                 string         `json:"path"`
+	Description          string         `json:"description"`
+	IncludeSubcategories bool           `json:"include_subcategories"`
+	Stats                *categorystats `json:"stats"`
+}
+
+// productfilter holds the filters, sort order and page of a product query.
+// Unset boolean filters are nil.
+type productfilter struct {
+	CategoryID    int
+	FeedID        int
+	Brand         string
+	InStock       *bool
+	HasCategories *bool
+	MinPrice      float64
+	MaxPrice      float64
+	Deleted       string
+	Sort          string
+	Descending    bool
+	Cursor        *productcursor
+	Limit         int
+}
+
+// productcursor is the position after the last product of a page.
+type productcursor struct {
+	Value interface{} `json:"v"`
+	ID    int         `json:"id"`
+}
+
+func (c productcursor) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseProductCursor(str string) (*productcursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("Invalid cursor.")
+	}
+	c := &productcursor{}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, errors.New("Invalid cursor.")
+	}
+	return c, nil
+}
+
+func parseOptionalBool(str string) (*bool, error) {
+	if str == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(str)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// productFilterFromRequest reads the filters of a product listing.
+func productFilterFromRequest(req *http.Request) (productfilter, error) {
+	var err error
+	f := productfilter{Sort: "id", Deleted: "0", Limit: defaultPageSize}
+
+	f.CategoryID, _ = strconv.Atoi(req.FormValue("category"))
+	f.FeedID, _ = strconv.Atoi(req.FormValue("feed"))
+	f.Brand = req.FormValue("brand")
+	f.MinPrice, _ = strconv.ParseFloat(req.FormValue("min_price"), 64)
+	f.MaxPrice, _ = strconv.ParseFloat(req.FormValue("max_price"), 64)
+
+	f.InStock, err = parseOptionalBool(req.FormValue("in_stock"))
+	if err != nil {
+		return f, errors.New("Invalid in_stock.")
+	}
+	f.HasCategories, err = parseOptionalBool(req.FormValue("has_categories"))
+	if err != nil {
+		return f, errors.New("Invalid has_categories.")
+	}
+
+	if deleted := req.FormValue("deleted"); deleted != "" {
+		if deleted != "0" && deleted != "1" && deleted != "all" {
+			return f, errors.New("Invalid deleted, use 0, 1 or all.")
+		}
+		f.Deleted = deleted
+	}
+
+	if sort := req.FormValue("sort"); sort != "" {
+		f.Descending = strings.HasPrefix(sort, "-")
+		f.Sort = strings.TrimPrefix(sort, "-")
+		if _, ok := productSortColumns[f.Sort]; !ok {
+			return f, errors.New("Invalid sort.")
+		}
+	}
+
+	if limit, err := strconv.Atoi(req.FormValue("limit")); err == nil && limit > 0 {
+		f.Limit = limit
+		if f.Limit > maxPageSize {
+			f.Limit = maxPageSize
+		}
+	}
+
+	if cursor := req.FormValue("cursor"); cursor != "" {
+		f.Cursor, err = parseProductCursor(cursor)
+		if err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// newProductResource turns p into what the API returns.
+func newProductResource(p product) productresource {
+	r := productresource{
+		ID:               p.ID,
+		SiteID:           p.SiteID,
+		FeedID:           p.FeedID,
+		Name:             p.getName(),
+		FeedName:         p.Name,
+		Slug:             p.Slug,
+		Identifier:       p.Identifier,
+		Brand:            p.Brand,
+		MerchantCategory: p.MerchantCategory,
+		Description:      p.Description,
+		Price:            p.Price,
+		RegularPrice:     p.RegularPrice,
+		ShippingPrice:    p.ShippingPrice,
+		Currency:         p.Currency,
+		URL:              p.ProductURL,
+		GraphicURL:       p.GraphicURL,
+		InStock:          p.InStock,
+		HasCategories:    p.HasCategories,
+		Active:           p.Active,
+		CreatedAt:        p.CreatedAt,
+		UpdatedAt:        p.UpdatedAt,
+	}
+	if p.DescriptionByUser != "" {
+		r.Description = p.DescriptionByUser
+	}
+	if p.DeletedAt.Valid {
+		r.DeletedAt = &p.DeletedAt.String
+	}
+	return r
+}
+
+// sortValue returns the value of the sort column of p for the cursor.
+func (f productfilter) sortValue(p product) interface{} {
+	switch f.Sort {
+	case "name":
+		return p.getName()
+	case "price":
+		return p.Price
+	case "updated_at":
+		return p.UpdatedAt
+	}
+	return p.ID
+}
+
+// queryProducts returns a page of the products of the site.
+func (s *session) queryProducts(f productfilter) (productpage, error) {
+	page := productpage{Products: []productresource{}}
+	where := []string{"site_id = ?"}
+	args := []interface{}{s.site.ID}
+
+	if f.CategoryID > 0 {
+		where = append(where, "EXISTS (SELECT 1 FROM category_product cp "+
+			"WHERE cp.product_id = products.id AND cp.category_id = ?)")
+		args = append(args, f.CategoryID)
+	}
+	if f.FeedID > 0 {
+		where = append(where, "feed_id = ?")
+		args = append(args, f.FeedID)
+	}
+	if f.Brand != "" {
+		where = append(where, "brand = ?")
+		args = append(args, f.Brand)
+	}
+	if f.InStock != nil {
+		where = append(where, "in_stock = ?")
+		args = append(args, *f.InStock)
+	}
+	if f.HasCategories != nil {
+		where = append(where, "has_categories = ?")
+		args = append(args, *f.HasCategories)
+	}
+	if f.MinPrice > 0 {
+		where = append(where, "price >= ?")
+		args = append(args, f.MinPrice)
+	}
+	if f.MaxPrice > 0 {
+		where = append(where, "price <= ?")
+		args = append(args, f.MaxPrice)
+	}
+	switch f.Deleted {
+	case "0":
+		where = append(where, "deleted_at IS NULL")
+	case "1":
+		where = append(where, "deleted_at IS NOT NULL")
+	}
+
+	column := productSortColumns[f.Sort]
+	direction, compare := "ASC", ">"
+	if f.Descending {
+		direction, compare = "DESC", "<"
+	}
+	if f.Cursor != nil {
+		if column == "id" {
+			where = append(where, "id "+compare+" ?")
+			args = append(args, f.Cursor.ID)
+		} else {
+			where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, compare, column, compare))
+			args = append(args, f.Cursor.Value, f.Cursor.Value, f.Cursor.ID)
+		}
+	}
+
+	order := "id " + direction
+	if column != "id" {
+		order = column + " " + direction + ", " + order
+	}
+	args = append(args, f.Limit+1)
+
+	rows, err := s.db.Query(
+		"SELECT "+siteProductColumns+" FROM products WHERE "+
+			strings.Join(where, " AND ")+" ORDER BY "+order+" LIMIT ?", args...)
+	if err != nil {
+		log.Println(err)
+		return page, err
+	}
+
+	defer rows.Close()
+	var last product
+	for rows.Next() {
+		p, err := scanSiteProduct(rows)
+		if err != nil {
+			log.Println(err)
+			return page, err
+		}
+		if len(page.Products) == f.Limit {
+			page.NextCursor = productcursor{Value: f.sortValue(last), ID: last.ID}.String()
+			break
+		}
+		page.Products = append(page.Products, newProductResource(p))
+		last = p
+	}
+	return page, rows.Err()
+}
+
+// selectProduct loads a product of the site with its categories.
+func (s *session) selectProduct(id int) (productresource, error) {
+	rows, err := s.db.Query(
+		"SELECT "+siteProductColumns+" FROM products WHERE site_id = ? AND id = ?",
+		s.site.ID, id)
+	if err != nil {
+		log.Println(err)
+		return productresource{}, err
+	}
+
+	defer rows.Close()
+	if !rows.Next() {
+		err = rows.Err()
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return productresource{}, err
+	}
+	p, err := scanSiteProduct(rows)
+	if err != nil {
+		log.Println(err)
+		return productresource{}, err
+	}
+
+	r := newProductResource(p)
+	r.Categories = []productcategory{}
+	categories, err := p.selectCategories(s)
+	if err != nil {
+		return r, err
+	}
+	for _, ci := range categories {
+		cp, ok := ci.(*categoryproduct)
+		if ok {
+			r.Categories = append(r.Categories, productcategory{
+				ID:     cp.CategoryID,
+				Name:   cp.category.Name,
+				Forced: cp.Forced,
+			})
+		}
+	}
+	return r, nil
+}
+
+// queryCategories lists the categories of the site with their stats, in
+// path order.
+func (s *session) queryCategories() ([]categoryresource, error) {
+	categories := []categoryresource{}
+	rows, err := s.db.Query(
+		"SELECT c.id, c.parent_id, c.name, c.slug, c.path, c.description, "+
+			"c.rendered_description, c.include_subcategories, cs.product_count, "+
+			"cs.min_price, cs.max_price, cs.on_sale_count, cs.brands "+
+			"FROM categories c LEFT JOIN category_stats cs ON cs.category_id = c.id "+
+			"WHERE c.site_id = ? AND c.deleted_at IS NULL ORDER BY c.path, c.id",
+		s.site.ID)
+	if err != nil {
+		log.Println(err)
+		return categories, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var parentID, count, onSale sql.NullInt64
+		var path, rendered, brands sql.NullString
+		var minPrice, maxPrice sql.NullFloat64
+		c := categoryresource{}
+		err := rows.Scan(&c.ID, &parentID, &c.Name, &c.Slug, &path, &c.Description,
+			&rendered, &c.IncludeSubcategories, &count, &minPrice, &maxPrice,
+			&onSale, &brands)
+		if err != nil {
+			log.Println(err)
+			return categories, err
+		}
+		c.ParentID = int(parentID.Int64)
+		c.Path = path.String
+		if rendered.Valid {
+			c.Description = rendered.String
+		}
+		if count.Valid {
+			c.Stats = &categorystats{
+				CategoryID:   c.ID,
+				ProductCount: int(count.Int64),
+				MinPrice:     minPrice.Float64,
+				MaxPrice:     maxPrice.Float64,
+				OnSaleCount:  int(onSale.Int64),
+				Brands:       []string{},
+			}
+			json.Unmarshal([]byte(brands.String), &c.Stats.Brands)
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// productsHandler serves GET /products?site=... with a filtered page of
+// products and GET /products/{id} with a product and its categories.
+func productsHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/products"), "/")
+		if resp.Success && path == "" {
+			f, err := productFilterFromRequest(req)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				resp = Response{Success: false, Message: err.Error()}
+			} else if page, err := s.queryProducts(f); err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(page.Products)) + " products.",
+					Data:    page,
+				}
+			}
+		} else if resp.Success {
+			id, _ := strconv.Atoi(path)
+			p, err := s.selectProduct(id)
+			if err == sql.ErrNoRows {
+				rw.WriteHeader(http.StatusNotFound)
+				resp = Response{Success: false, Message: "Product not found."}
+			} else if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{Success: true, Message: p.Name, Data: p}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// categoriesHandler lists the categories of a site with their stats.
+func categoriesHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "GET" {
+		rw.Header().Set("Content-Type", "application/json")
+		s, resp := getSiteSession(req)
+		defer s.db.Close()
+
+		if resp.Success {
+			categories, err := s.queryCategories()
+			if err != nil {
+				resp = Response{Success: false, Message: err.Error()}
+			} else {
+				resp = Response{
+					Success: true,
+					Message: strconv.Itoa(len(categories)) + " categories.",
+					Data:    categories,
+				}
+			}
+		}
+
+		fmt.Fprint(rw, resp)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
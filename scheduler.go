@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Priorities of queued jobs. Manual jobs run before scheduled ones.
+const PRIORITY_MANUAL = "manual"
+const PRIORITY_SCHEDULED = "scheduled"
+
+// jobPollInterval is how often the scheduler looks for jobs queued by
+// other instances and for expired leases.
+const jobPollInterval = 5 * time.Second
+
+// scheduler runs the jobs of the jobs table, at most maxConcurrentJobs at
+// once on this instance. The table makes sure that at most one job runs
+// per site over all instances.
+type scheduler struct {
+	mutex    sync.Mutex
+	instance string
+	running  int
+	wake     chan bool
+}
+
+var jobScheduler = &scheduler{wake: make(chan bool, 1)}
+
+// requestPriority returns the priority asked for with priority=scheduled,
+// which cron jobs should send. Anything else is a manual trigger.
+func requestPriority(req *http.Request) string {
+	if req.FormValue("priority") == PRIORITY_SCHEDULED {
+		return PRIORITY_SCHEDULED
+	}
+	return PRIORITY_MANUAL
+}
+
+func priorityRank(priority string) int {
+	if priority == PRIORITY_SCHEDULED {
+		return 1
+	}
+	return 0
+}
+
+// start queues the jobs this instance was running when it stopped again
+// and starts running jobs.
+func (sch *scheduler) start(instance string) {
+	sch.instance = instance
+	err := requeueJobs(instance)
+	if err != nil {
+		log.Println(err)
+	}
+	go sch.loop()
+}
+
+// enqueue queues action for the site of s and returns the id of its job.
+// The session is closed; the instance that runs the job opens its own.
+func (sch *scheduler) enqueue(s session, action string, priority string) (int, error) {
+	defer s.db.Close()
+
+	id, err := insertJob(&s, action, priority)
+	if err != nil {
+		return 0, err
+	}
+	if s.apiRequest != nil {
+		s.apiRequest.JobID = id
+	}
+	sch.notify()
+	return id, nil
+}
+
+// notify wakes the scheduler without waiting for the next poll.
+func (sch *scheduler) notify() {
+	select {
+	case sch.wake <- true:
+	default:
+	}
+}
+
+func (sch *scheduler) loop() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		err := requeueJobs("")
+		if err != nil {
+			log.Println(err)
+		}
+		sch.dispatch()
+
+		select {
+		case <-sch.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// reserve takes a slot for a job, if one is free.
+func (sch *scheduler) reserve() bool {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+	if sch.running >= *maxConcurrentJobs {
+		return false
+	}
+	sch.running++
+	return true
+}
+
+func (sch *scheduler) release() {
+	sch.mutex.Lock()
+	defer sch.mutex.Unlock()
+	sch.running--
+}
+
+// dispatch claims and starts jobs while there are free slots.
+func (sch *scheduler) dispatch() {
+	for sch.reserve() {
+		r, ok, err := claimJob(sch.instance)
+		if err != nil {
+			log.Println(err)
+		}
+		if err != nil || !ok {
+			sch.release()
+			return
+		}
+		go sch.run(r)
+	}
+}
+
+// run runs a claimed job and records how it ended.
+func (sch *scheduler) run(r jobrow) {
+	defer func() {
+		sch.release()
+		sch.notify()
+	}()
+	queueWaitDuration.WithLabelValues(r.Action).Observe(time.Since(r.QueuedAt).Seconds())
+
+	s, err := r.session()
+	s.job = jobs.add(&s, r)
+	s.ctx = s.job.ctx
+	go sch.heartbeat(s.job)
+
+	if err != nil {
+		log.Println(err)
+		if s.db != nil {
+			s.db.Close()
+		}
+		s.job.start()
+		s.job.fail(err)
+		s.job.finish()
+	} else {
+		runAction(s, r.Action)
+	}
+
+	err = saveJobResult(s.job, sch.instance)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// heartbeat renews the lease of a running job until it finishes. The job
+// is cancelled when its lease is lost, since another instance may run it
+// by then, and when cancelling it was requested on another instance.
+func (sch *scheduler) heartbeat(j *job) {
+	ticker := time.NewTicker(jobLease / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-j.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lost, cancel, err := renewLease(j.ID, sch.instance)
+		if err != nil {
+			log.Println(err)
+			if time.Since(renewed) < jobLease {
+				continue
+			}
+			lost = true
+		}
+		if lost {
+			log.Printf("Lost the lease of job %d", j.ID)
+			j.cancel()
+			return
+		}
+		renewed = time.Now()
+		if cancel {
+			j.stopRun()
+		}
+	}
+}
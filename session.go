@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -14,6 +16,7 @@ const DBACTION_UPDATE = 2
 const DBACTION_DELETE = 3
 
 type session struct {
+	ctx                                               context.Context
 	db                                                *sql.DB
 	selectSiteStmt                                    *sql.Stmt
 	selectFeedStmt                                    *sql.Stmt
@@ -29,11 +32,31 @@ type session struct {
 	selectCategoryProductByCategoryProductIDStmt      *sql.Stmt
 	selectCategoryCountByProductIDStmt                *sql.Stmt
 	insertCategoryProductStmt                         *sql.Stmt
-	searchCategoryProductsStmt                        *sql.Stmt
+	selectSiteProductsStmt                            *sql.Stmt
 	deleteCategoryProductStmt                         *sql.Stmt
+	selectValidationRulesStmt                         *sql.Stmt
+	selectRejectionsStmt                              *sql.Stmt
+	selectSiteOffersStmt                              *sql.Stmt
+	selectCanonicalOffersStmt                         *sql.Stmt
 	site                                              *site
 	feeds                                             []*feed
 	categories                                        []categoryinterface
+	syncing                                           []categoryinterface
+	onlyCategoryID                                    int
+	previousParentID                                  int
+	siteProducts                                      []product
+	searchDocuments                                   map[int]searchdocument
+	matches                                           map[int][]product
+	categoryMappings                                  []categorymapping
+	feedNetworks                                      map[int]int
+	changes                                           *changeset
+	job                                               *job
+	apiRequest                                        *apirequest
+	changedProducts                                   []product
+	changedRelations                                  map[int]map[int]categoryproduct
+	changedExclusions                                 map[int]map[int]bool
+	changedOnly                                       bool
+	skipCategories                                    bool
 	DBOperation                                       chan message
 	FeedDone                                          chan feedmessage
 	FeedError                                         chan feedmessage
@@ -42,11 +65,11 @@ type session struct {
 
 func (s *session) init(subdomain string) error {
 	var err error
+	s.ctx = context.Background()
 	// This does not really open a new connection.
-	var DSN = fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", *dbUser, *dbPassword, *dbAddr, *dbPort, *database)
-	s.db, err = sql.Open("mysql", DSN)
+	s.db, err = sql.Open("mysql", dataSourceName())
 	if err != nil {
-		log.Println("Error on initializing database connection: %s",
+		log.Printf("Error on initializing database connection: %s",
 			err.Error())
 	}
 
@@ -56,13 +79,13 @@ func (s *session) init(subdomain string) error {
 	// This makes sure the database is accessible.
 	err = s.db.Ping()
 	if err != nil {
-		log.Println("Error on opening database connection: %s",
+		log.Printf("Error on opening database connection: %s",
 			err.Error())
 	} else {
 		s.prepareSelectSiteStmt()
 		s.prepareSelectFeedsStmt()
 		s.prepareSelectCategoryStmt()
-		s.prepareSearchCategoryProductsStmt()
+		s.prepareSelectSiteProductsStmt()
 		s.prepareSelectFeedProductsStmt()
 		s.prepareSelectFeedNetworkStmt()
 		s.prepareSelectCategoryProductStmt()
@@ -70,6 +93,9 @@ func (s *session) init(subdomain string) error {
 		s.prepareSelectCategoryProductByProductIDAndCategoryIDStmt()
 		s.prepareSelectCategoryProductsByCategoryIDStmt()
 		s.prepareSelectCategoryProductByCategoryProductIDStmt()
+		s.prepareSelectValidationRulesStmt()
+		s.prepareSelectRejectionsStmt()
+		s.prepareSelectOffersStmts()
 	}
 
 	s.selectSite(subdomain)
@@ -79,7 +105,8 @@ func (s *session) init(subdomain string) error {
 func (s *session) prepareSelectSiteStmt() {
 	var err error
 	s.selectSiteStmt, err = s.db.Prepare(
-		"SELECT id, name, subdomain FROM sites WHERE subdomain = ?")
+		"SELECT id, name, subdomain, plain_text_descriptions " +
+			"FROM sites WHERE subdomain = ?")
 	if err != nil {
 		log.Println(err)
 	}
@@ -89,7 +116,7 @@ func (s *session) prepareSelectFeedsStmt() {
 	var err error
 	s.selectFeedStmt, err = s.db.Prepare(
 		"SELECT f.id, f.site_id, f.name, f.url, f.network_id, " +
-			"f.allow_empty_description " +
+			"f.allow_empty_description, f.identity_strategy " +
 			"FROM feeds as f " +
 			"WHERE f.site_id = ?")
 	if err != nil {
@@ -99,9 +126,11 @@ func (s *session) prepareSelectFeedsStmt() {
 
 func (s *session) prepareSelectCategoryStmt() {
 	var err error
-	s.selectCategoryStmt, err = s.db.Prepare("SELECT id, name, slug, " +
-		"search, description FROM categories " +
-		"WHERE site_id = ?")
+	s.selectCategoryStmt, err = s.db.Prepare("SELECT id, parent_id, name, " +
+		"slug, path, search, rules, description, include_subcategories, " +
+		"synced_hash " +
+		"FROM categories " +
+		"WHERE site_id = ? AND deleted_at IS NULL")
 	if err != nil {
 		log.Println(err)
 	}
@@ -117,12 +146,10 @@ func (s *session) prepareSelectCategoryCountByProductIDStmt() {
 	}
 }
 
-func (s *session) prepareSearchCategoryProductsStmt() {
+func (s *session) prepareSelectSiteProductsStmt() {
 	var err error
-	s.searchCategoryProductsStmt, err = s.db.Prepare("SELECT * FROM products " +
-		"WHERE site_id = ? " +
-		"AND MATCH(`name`,`description`) " +
-		"AGAINST (? IN BOOLEAN MODE)")
+	s.selectSiteProductsStmt, err = s.db.Prepare(
+		"SELECT " + siteProductColumns + " FROM products WHERE site_id = ?")
 	if err != nil {
 		log.Println(err)
 	}
@@ -131,10 +158,11 @@ func (s *session) prepareSearchCategoryProductsStmt() {
 func (s *session) prepareSelectFeedProductsStmt() {
 	var err error
 	s.selectFeedProductsStmt, err = s.db.Prepare(
-		"SELECT id, site_id, feed_id, name, name_by_user, identifier, price, " +
-			"regular_price, description, description_by_user, " +
+		"SELECT id, site_id, feed_id, name, name_by_user, slug, identifier, price, " +
+			"regular_price, description, description_text, description_by_user, " +
 			"currency, url, graphic_url, shipping_price, in_stock, " +
-			"points, has_categories, active, deleted_at " +
+			"points, has_categories, active, ean, mpn, brand, merchant_category, " +
+			"deleted_at " +
 			"FROM products WHERE feed_id = ?")
 	if err != nil {
 		log.Println(err)
@@ -214,6 +242,53 @@ func (s *session) prepareSelectCategoryProductByProductIDAndCategoryIDStmt() {
 	}
 }
 
+func (s *session) prepareSelectValidationRulesStmt() {
+	var err error
+	s.selectValidationRulesStmt, err = s.db.Prepare(
+		"SELECT require_image, min_description_length, require_price, " +
+			"currencies, require_valid_url, min_name_length, max_name_length, " +
+			"invalid_action " +
+			"FROM validation_rules " +
+			"WHERE site_id = ? AND (feed_id = ? OR feed_id IS NULL) " +
+			"ORDER BY feed_id IS NULL LIMIT 1")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *session) prepareSelectRejectionsStmt() {
+	var err error
+	s.selectRejectionsStmt, err = s.db.Prepare(
+		"SELECT product_id, feed_id, identifier, name, reason, created_at " +
+			"FROM product_rejections " +
+			"WHERE feed_id = ? AND site_id = ? " +
+			"ORDER BY name")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *session) prepareSelectOffersStmts() {
+	var err error
+	query := "SELECT p.id, p.feed_id, f.name, p.name, p.ean, p.brand, p.mpn, " +
+		"p.price, p.shipping_price, p.currency, p.url, p.in_stock, " +
+		"p.canonical_product_id " +
+		"FROM products p INNER JOIN feeds f ON f.id = p.feed_id " +
+		"WHERE p.deleted_at IS NULL "
+
+	s.selectSiteOffersStmt, err = s.db.Prepare(query + "AND p.site_id = ?")
+	if err != nil {
+		log.Println(err)
+	}
+
+	s.selectCanonicalOffersStmt, err = s.db.Prepare(query +
+		"AND p.canonical_product_id = ? " +
+		"ORDER BY p.in_stock DESC, p.price + p.shipping_price")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (s *session) selectFeeds() error {
 	s.feeds = []*feed{}
 	rows, err := s.selectFeedStmt.Query(s.site.ID)
@@ -231,6 +306,7 @@ func (s *session) selectFeeds() error {
 			&f.URL,
 			&f.NetworkID,
 			&f.AllowEmptyDescription,
+			&f.IdentityStrategy,
 		)
 
 		if err != nil {
@@ -246,10 +322,21 @@ func (s *session) selectFeeds() error {
 	return err
 }
 
+// findFeed returns the selected feed with the given id, or nil.
+func (s *session) findFeed(id int) *feed {
+	for _, f := range s.feeds {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
 func (s *session) prepare() {
 	s.FeedDone = make(chan feedmessage, len(s.feeds))
 	s.FeedError = make(chan feedmessage, len(s.feeds))
 	s.DBOperation = make(chan message)
+	s.changes = newChangeset()
 
 	// Run 5 worker instances for db actions
 	for i := 0; i < 5; i++ {
@@ -264,46 +351,122 @@ func (s *session) waitForResult() {
 			log.Println(m.feed.Name + " " + m.action + " completed.")
 		case m := <-s.FeedError:
 			log.Println("Errors in "+m.feed.Name+" "+m.action, m.err)
-			<-SessionQueue
 		}
 		log.Println("WaitForResult: " + strconv.Itoa(i) + "/" + strconv.Itoa(len(s.feeds)))
-		if i == len(s.feeds) {
-			s.syncProductCategories()
-			s.waitForRefreshResult()
+		if i == len(s.feeds) && s.ctx.Err() == nil {
+			err := s.matchOffers()
+			if err != nil {
+				log.Println(err)
+				s.job.fail(err)
+			} else {
+				s.job.stageCompleted("offers matched")
+			}
+			if !s.skipCategories {
+				s.syncProductCategories()
+				s.waitForRefreshResult()
+			}
 		}
 	}
 }
 
 func (s *session) waitForRefreshResult() {
-	for i := 1; i < len(s.categories)+1; i++ {
+	for i := 1; i < len(s.syncing)+1; i++ {
 		select {
 		case m := <-s.CategoryDone:
 			log.Println(m.category.Name + " completed.")
+		case <-s.ctx.Done():
+			log.Println("Session cancelled: " + s.site.Name)
+			return
 		}
-		log.Println("WaitForRefreshResult: " + strconv.Itoa(i) + "/" + strconv.Itoa(len(s.categories)))
-		if i == len(s.categories) {
-			log.Println("Session done: " + s.site.Name)
-			<-SessionQueue
+		log.Println("WaitForRefreshResult: " + strconv.Itoa(i) + "/" + strconv.Itoa(len(s.syncing)))
+	}
+	log.Println("Session done: " + s.site.Name)
+}
+
+// categoriesToSync returns the categories a refresh syncs: all of them, or
+// when the session is limited to one category, that category and the
+// ancestors that include its products, including those it was moved away
+// from.
+func (s *session) categoriesToSync() []categoryinterface {
+	if s.onlyCategoryID == 0 {
+		return s.categories
+	}
+
+	byID := s.categoriesByID()
+	c, ok := byID[s.onlyCategoryID]
+	if !ok {
+		return []categoryinterface{}
+	}
+
+	syncing := []categoryinterface{c}
+	seen := map[int]bool{c.ID: true}
+	ancestors, _ := categoryAncestors(byID, c)
+
+	// A category that moved leaves the products of its tree behind in its
+	// old ancestors.
+	if old, ok := byID[s.previousParentID]; ok {
+		oldAncestors, _ := categoryAncestors(byID, old)
+		ancestors = append(append(ancestors, old), oldAncestors...)
+	}
+	for _, a := range ancestors {
+		if a.IncludeSubcategories && !seen[a.ID] {
+			seen[a.ID] = true
+			syncing = append(syncing, a)
 		}
 	}
+	return syncing
 }
 
 func (s *session) syncProductCategories() {
 	var err error
 	s.categories, err = s.selectCategories()
-	s.CategoryDone = make(chan categorymessage, len(s.categories))
 	if err != nil {
 		log.Print(err)
 	}
 
-	for _, c := range s.categories {
+	err = s.updateCategoryPaths()
+	if err != nil {
+		log.Print(err)
+	}
+
+	s.syncing = s.categoriesToSync()
+	s.CategoryDone = make(chan categorymessage, len(s.syncing))
+	s.job.categoriesStarted(len(s.syncing))
+
+	// Categories whose rules changed are synced against every product of
+	// the site. The others only look at the products this run changed.
+	full, changed := s.splitCategorySync(s.syncing)
+	for _, c := range full {
+		if s.ctx.Err() != nil {
+			return
+		}
 		log.Println("Syncing category " + c.getName())
 		err = c.syncProducts(s)
 		if err != nil {
 			log.Print(err)
 		}
+		s.job.categorySynced(c.getName(), err)
+	}
 
+	if len(changed) > 0 {
+		s.matches = nil
+		err = s.selectChangedProducts()
+		if err != nil {
+			log.Print(err)
+		}
 	}
+	for _, c := range changed {
+		if s.ctx.Err() != nil {
+			return
+		}
+		log.Println("Syncing changed products of category " + c.getName())
+		err = c.syncChangedProducts(s)
+		if err != nil {
+			log.Print(err)
+		}
+		s.job.categorySynced(c.getName(), err)
+	}
+	s.job.stageCompleted("categories synced")
 }
 
 func (s *session) update() {
@@ -312,8 +475,16 @@ func (s *session) update() {
 	for _, f := range s.feeds {
 		var err error
 		f.Network, err = f.selectNetwork(s)
+		if err == nil {
+			err = s.ctx.Err()
+		}
+		if err == nil && f.Network == nil {
+			err = errors.New("Invalid network id")
+		}
 		if err != nil {
 			log.Println(err)
+			s.job.feedFinished(f, err)
+			s.FeedError <- feedmessage{feed: f, err: err, action: "update"}
 		} else {
 			go f.update(s)
 		}
@@ -321,9 +492,12 @@ func (s *session) update() {
 	s.waitForResult()
 }
 
+// refresh fully syncs the categories of the session. Only the category
+// sync at the end of an update is limited to the products it changed.
 func (s *session) refresh() {
 	defer s.db.Close()
 
+	s.changes = nil
 	s.syncProductCategories()
 	s.waitForRefreshResult()
 }
@@ -333,17 +507,24 @@ func (s *session) worker() {
 	for {
 		var err error
 		select {
+		case <-s.ctx.Done():
+			wg.Wait()
+			return
 		case message := <-s.DBOperation:
 			switch message.product.getDBAction() {
 			case DBACTION_INSERT:
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
+					start := time.Now()
 					err = message.product.insert(s)
+					observeProductWrite(message.feed, DBACTION_INSERT, start, err)
+					s.job.productWritten(message.feed, DBACTION_INSERT, err)
 					if err != nil {
 						log.Println(err)
 						message.feed.DBOperationError <- err
 					} else {
+						s.changes.add(message.product.ID)
 						message.feed.DBOperationDone <- fmt.Sprintf(
 							"Inserted %s: '%s'.",
 							message.product.getEntityType(),
@@ -355,11 +536,15 @@ func (s *session) worker() {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
+					start := time.Now()
 					err = message.product.update(s)
+					observeProductWrite(message.feed, DBACTION_UPDATE, start, err)
+					s.job.productWritten(message.feed, DBACTION_UPDATE, err)
 					if err != nil {
 						log.Println(err)
 						message.feed.DBOperationError <- err
 					} else {
+						s.changes.add(message.product.ID)
 						message.feed.DBOperationDone <- fmt.Sprintf(
 							"Updated %s: '%s'.",
 							message.product.getEntityType(),
@@ -371,11 +556,15 @@ func (s *session) worker() {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
+					start := time.Now()
 					err = message.product.delete(s)
+					observeProductWrite(message.feed, DBACTION_DELETE, start, err)
+					s.job.productWritten(message.feed, DBACTION_DELETE, err)
 					if err != nil {
 						log.Println(err)
 						message.feed.DBOperationError <- err
 					} else {
+						s.changes.add(message.product.ID)
 						message.feed.DBOperationDone <- fmt.Sprintf(
 							"Deleted %s: '%s'.",
 							message.product.getEntityType(),
@@ -404,7 +593,7 @@ func (s *session) selectSite(subdomain string) (site, error) {
 	defer rows.Close()
 	for rows.Next() {
 		si = site{}
-		err := rows.Scan(&si.ID, &si.Name, &si.Subdomain)
+		err := rows.Scan(&si.ID, &si.Name, &si.Subdomain, &si.PlainTextDescriptions)
 		if err != nil {
 			log.Println(err)
 		}
@@ -433,19 +622,37 @@ func (s *session) selectCategories() ([]categoryinterface, error) {
 
 	defer rows.Close()
 	for rows.Next() {
+		var parentID sql.NullInt64
+		var path, rules, syncedHash sql.NullString
 		c := category{}
 		err := rows.Scan(
 			&c.ID,
+			&parentID,
 			&c.Name,
 			&c.Slug,
+			&path,
 			&c.Search,
+			&rules,
 			&c.Description,
+			&c.IncludeSubcategories,
+			&syncedHash,
 		)
 		if err != nil {
 			log.Println(err)
-		} else {
-			categories = append(categories, &c)
+			continue
+		}
+		c.ParentID = int(parentID.Int64)
+		c.Path = path.String
+		c.SyncedHash = syncedHash.String
+
+		// A category with broken rules is left alone rather than synced
+		// as if it had none.
+		c.Rules, err = parseCategoryRules(rules)
+		if err != nil {
+			log.Println("Invalid rules for category "+c.Name+":", err)
+			continue
 		}
+		categories = append(categories, &c)
 	}
 
 	err = rows.Err()
@@ -3,9 +3,10 @@ package main
 import "encoding/json"
 
 type site struct {
-	ID        int64
-	Name      string
-	Subdomain string
+	ID                    int64
+	Name                  string
+	Subdomain             string
+	PlainTextDescriptions bool
 }
 
 func (site site) String() (s string) {
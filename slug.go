@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/text/unicode/norm"
+)
+
+// slugMutex serialises picking a free slug and writing it on this instance.
+// Other instances are caught by the unique (site_id, slug) indexes, after
+// which the write is retried with the next free slug.
+var slugMutex sync.Mutex
+
+// slugAttempts is how many times a write is retried when another instance
+// took the slug first.
+const slugAttempts = 5
+
+// transliterations covers the letters that do not decompose into an ASCII
+// letter and a combining mark.
+var transliterations = map[rune]string{
+	'ß': "ss",
+	'æ': "ae",
+	'ø': "o",
+	'œ': "oe",
+	'ð': "d",
+	'þ': "th",
+	'đ': "d",
+	'ł': "l",
+}
+
+// generateSlug returns a lower case, dash separated and transliterated
+// version of str, e.g. "Löparskor för Herrar" becomes "loparskor-for-herrar".
+func generateSlug(str string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range norm.NFD.String(strings.ToLower(strings.TrimSpace(str))) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case transliterations[r] != "":
+			b.WriteString(transliterations[r])
+			dash = false
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// Letters without an ASCII form, e.g. Cyrillic, are kept as is.
+			b.WriteRune(r)
+			dash = false
+		default:
+			if !dash && b.Len() > 0 {
+				b.WriteRune('-')
+				dash = true
+			}
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
+
+// uniqueSlug returns slug, or slug with the lowest free numeric suffix, so
+// that it is unique among the entities of the site. Slugs in the history
+// of other entities are taken as well, since they still redirect.
+func uniqueSlug(s *session, entityType string, siteID int, slug string, id int) (string, error) {
+	if slug == "" {
+		slug = entityType
+	}
+
+	table := "products"
+	if entityType == "category" {
+		table = "categories"
+	}
+
+	rows, err := s.db.Query(
+		"SELECT slug FROM "+table+" WHERE site_id = ? AND id <> ? "+
+			"AND (slug = ? OR slug LIKE ?) "+
+			"UNION SELECT slug FROM slug_history WHERE site_id = ? "+
+			"AND entity_type = ? AND entity_id <> ? AND (slug = ? OR slug LIKE ?)",
+		siteID, id, slug, slug+"-%",
+		siteID, entityType, id, slug, slug+"-%",
+	)
+	if err != nil {
+		log.Println(err)
+		return slug, err
+	}
+
+	defer rows.Close()
+	taken := make(map[string]bool)
+	for rows.Next() {
+		var t string
+		err := rows.Scan(&t)
+		if err != nil {
+			log.Println(err)
+			return slug, err
+		}
+		taken[t] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return slug, err
+	}
+
+	unique := slug
+	for i := 2; taken[unique]; i++ {
+		unique = slug + "-" + strconv.Itoa(i)
+	}
+	return unique, nil
+}
+
+// isDuplicateSlug reports whether err is a write that failed because the
+// slug is already taken in the site.
+func isDuplicateSlug(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "_site_slug_unique")
+}
+
+// saveSlugHistory remembers an old slug of an entity so its URL can be
+// redirected.
+func saveSlugHistory(s *session, entityType string, siteID int, id int, slug string) error {
+	if slug == "" {
+		return nil
+	}
+	_, err := s.db.Exec(
+		"INSERT INTO slug_history (site_id, entity_type, entity_id, slug, "+
+			"created_at) VALUES (?,?,?,?,now()) "+
+			"ON DUPLICATE KEY UPDATE entity_id = VALUES(entity_id), created_at = now()",
+		siteID, entityType, id, slug)
+	if err != nil {
+		log.Println(err)
+	}
+	return err
+}
+
+// resolveSlug finds the current slug for a possibly old slug. It returns
+// sql.ErrNoRows if the slug was never used.
+func resolveSlug(s *session, entityType string, slug string) (string, error) {
+	table := "products"
+	if entityType == "category" {
+		table = "categories"
+	}
+
+	var current string
+	err := s.db.QueryRow(
+		"SELECT slug FROM "+table+" WHERE site_id = ? AND slug = ?",
+		s.site.ID, slug).Scan(&current)
+	if err != sql.ErrNoRows {
+		return current, err
+	}
+
+	err = s.db.QueryRow(
+		"SELECT t.slug FROM slug_history h INNER JOIN "+table+" t "+
+			"ON t.id = h.entity_id "+
+			"WHERE h.site_id = ? AND h.entity_type = ? AND h.slug = ?",
+		s.site.ID, entityType, slug).Scan(&current)
+	return current, err
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestGenerateSlug(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Löparskor för Herrar", "loparskor-for-herrar"},
+		{"Åre Ängsö", "are-angso"},
+		{"Straße", "strasse"},
+		{"Smørrebrød & Œuvre", "smorrebrod-oeuvre"},
+		{"Crème brûlée", "creme-brulee"},
+		{"TV -- 55\" / 4K", "tv-55-4k"},
+		{"  --Jackor--  ", "jackor"},
+		{"Skor 2", "skor-2"},
+		{"Платья", "платья"},
+		{"", ""},
+		{" - ", ""},
+	}
+	for _, tt := range tests {
+		if got := generateSlug(tt.in); got != tt.want {
+			t.Errorf("generateSlug(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -10,8 +10,10 @@ type message struct {
 }
 
 type Response struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+	JobID   int         `json:"job_id,omitempty"`
 }
 
 func (r Response) String() (s string) {
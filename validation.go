@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const INVALID_SKIP = "skip"
+const INVALID_DEACTIVATE = "deactivate"
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// validationrules decide which feed products are good enough to publish.
+// Rules are stored per site, optionally overridden per feed.
+type validationrules struct {
+	RequireImage         bool
+	MinDescriptionLength int
+	RequirePrice         bool
+	Currencies           []string
+	RequireValidURL      bool
+	MinNameLength        int
+	MaxNameLength        int
+	InvalidAction        string
+}
+
+// rejection records why a feed product was not published.
+type rejection struct {
+	ProductID  int    `json:"product_id,omitempty"`
+	FeedID     int    `json:"feed_id"`
+	Identifier string `json:"identifier"`
+	Name       string `json:"name"`
+	Reason     string `json:"reason"`
+	CreatedAt  string `json:"created_at,omitempty"`
+}
+
+// defaultValidationRules mirrors what feeds did before rules were
+// configurable: an image is required, and so is a description unless the
+// feed allows empty descriptions.
+func defaultValidationRules(f *feed) validationrules {
+	rules := validationrules{
+		RequireImage:  true,
+		InvalidAction: INVALID_DEACTIVATE,
+	}
+	if f.AllowEmptyDescription == false {
+		rules.MinDescriptionLength = 1
+	}
+	return rules
+}
+
+// selectValidationRules loads the rules of the feed, falling back to the
+// rules of the site and then to the defaults.
+func (f *feed) selectValidationRules(s *session) (validationrules, error) {
+	rules := defaultValidationRules(f)
+
+	var currencies, action sql.NullString
+	err := s.selectValidationRulesStmt.QueryRow(f.SiteID, f.ID).Scan(
+		&rules.RequireImage,
+		&rules.MinDescriptionLength,
+		&rules.RequirePrice,
+		&currencies,
+		&rules.RequireValidURL,
+		&rules.MinNameLength,
+		&rules.MaxNameLength,
+		&action,
+	)
+	if err == sql.ErrNoRows {
+		return defaultValidationRules(f), nil
+	} else if err != nil {
+		log.Println(err)
+		return defaultValidationRules(f), err
+	}
+
+	for _, c := range strings.Split(currencies.String, ",") {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if c != "" {
+			rules.Currencies = append(rules.Currencies, c)
+		}
+	}
+
+	rules.InvalidAction = INVALID_DEACTIVATE
+	if action.String == INVALID_SKIP {
+		rules.InvalidAction = INVALID_SKIP
+	}
+	return rules, nil
+}
+
+// validate returns the reasons p breaks the rules, or nothing if it is valid.
+func (p *product) validate(rules validationrules) []string {
+	reasons := []string{}
+
+	if rules.RequireImage && !validURL(p.GraphicURL) {
+		reasons = append(reasons, "missing or invalid image")
+	}
+
+	length := utf8.RuneCountInString(p.DescriptionText)
+	if length < rules.MinDescriptionLength {
+		reasons = append(reasons, "description shorter than "+
+			strconv.Itoa(rules.MinDescriptionLength)+" characters")
+	}
+
+	if rules.RequirePrice && p.Price <= 0 {
+		reasons = append(reasons, "price is not above zero")
+	}
+
+	if !validCurrency(p.Currency, rules.Currencies) {
+		reasons = append(reasons, "invalid currency '"+p.Currency+"'")
+	}
+
+	if rules.RequireValidURL && !validURL(p.ProductURL) {
+		reasons = append(reasons, "invalid product URL")
+	}
+
+	length = utf8.RuneCountInString(p.Name)
+	if length == 0 || length < rules.MinNameLength {
+		reasons = append(reasons, "name too short")
+	} else if rules.MaxNameLength > 0 && length > rules.MaxNameLength {
+		reasons = append(reasons, "name longer than "+
+			strconv.Itoa(rules.MaxNameLength)+" characters")
+	}
+
+	return reasons
+}
+
+// validCurrency accepts any ISO 4217 shaped code, or only the listed ones
+// when a list is configured.
+func validCurrency(currency string, currencies []string) bool {
+	if len(currencies) == 0 {
+		return currency == "" || currencyPattern.MatchString(currency)
+	}
+	for _, c := range currencies {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
+
+func validURL(str string) bool {
+	u, err := url.Parse(str)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// saveRejections replaces the recorded rejections of the feed with the
+// ones from the current run.
+func (f *feed) saveRejections(s *session) error {
+	_, err := s.db.Exec("DELETE FROM product_rejections WHERE feed_id = ?", f.ID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	for _, r := range f.Rejections {
+		_, err = s.db.Exec(
+			"INSERT INTO product_rejections (site_id, feed_id, product_id, "+
+				"identifier, name, reason, created_at) VALUES (?,?,?,?,?,?,now())",
+			f.SiteID,
+			f.ID,
+			sql.NullInt64{Int64: int64(r.ProductID), Valid: r.ProductID > 0},
+			r.Identifier,
+			r.Name,
+			r.Reason,
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// selectRejections lists the products rejected in the last run of the feed.
+func (f feed) selectRejections(s *session) ([]rejection, error) {
+	rejections := []rejection{}
+	rows, err := s.selectRejectionsStmt.Query(f.ID, f.SiteID)
+	if err != nil {
+		log.Println(err)
+		return rejections, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var productID sql.NullInt64
+		r := rejection{}
+		err := rows.Scan(
+			&productID,
+			&r.FeedID,
+			&r.Identifier,
+			&r.Name,
+			&r.Reason,
+			&r.CreatedAt,
+		)
+		if err != nil {
+			log.Println(err)
+			return rejections, err
+		}
+		r.ProductID = int(productID.Int64)
+		rejections = append(rejections, r)
+	}
+
+	err = rows.Err()
+	return rejections, err
+}